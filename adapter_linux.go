@@ -0,0 +1,71 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/muka/go-bluetooth/bluez"
+	btadapter "github.com/muka/go-bluetooth/bluez/profile/adapter"
+)
+
+// selectAdapter makes the BlueZ adapter with the given ID, e.g. hci1, the one
+// used by adapter.Enable. It must be called before enabling the adapter.
+func selectAdapter(id string) error {
+	ids, err := adapterIDs()
+	if err != nil {
+		return fmt.Errorf("listing adapters: %w", err)
+	}
+	if !slices.Contains(ids, id) {
+		return fmt.Errorf("adapter %q not found, available adapters: %s", id, strings.Join(ids, ", "))
+	}
+	btadapter.SetDefaultAdapterID(id)
+	return nil
+}
+
+// adapterIDs returns the IDs of the adapters known to BlueZ.
+func adapterIDs() ([]string, error) {
+	om, err := bluez.GetObjectManager()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := om.GetManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for path, ifaces := range objects {
+		if _, ok := ifaces[btadapter.Adapter1Interface]; !ok {
+			continue
+		}
+		if id, err := btadapter.ParseAdapterID(path); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// canPowerCycle reports whether powerCycleAdapter is supported.
+const canPowerCycle = true
+
+// powerCycleAdapter powers the adapter used by adapter.Enable off and on
+// again, which resets its controller. Enabling the adapter again would not, as
+// it is a no-op once the adapter is enabled.
+func powerCycleAdapter() error {
+	a, err := btadapter.GetDefaultAdapter()
+	if err != nil {
+		return fmt.Errorf("getting adapter %s: %w", btadapter.GetDefaultAdapterID(), err)
+	}
+	defer a.Close()
+	if err := a.SetPowered(false); err != nil {
+		return fmt.Errorf("powering adapter off: %w", err)
+	}
+	if err := a.SetPowered(true); err != nil {
+		return fmt.Errorf("powering adapter on: %w", err)
+	}
+	return nil
+}
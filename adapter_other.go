@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// selectAdapter is only supported with BlueZ, other platforms always use the default adapter.
+func selectAdapter(id string) error {
+	return errors.New("selecting an adapter is only supported on Linux")
+}
+
+// canPowerCycle reports whether powerCycleAdapter is supported.
+const canPowerCycle = false
+
+// powerCycleAdapter is only supported with BlueZ.
+func powerCycleAdapter() error {
+	return errors.New("power-cycling the adapter is only supported on Linux")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"tinygo.org/x/bluetooth"
+)
+
+// alertFields are the values of a measurement alert rules can apply to, by
+// their JSON field name.
+var alertFields = map[string]func(Measurement) *float64{
+	"temperature":     func(m Measurement) *float64 { return m.TemperatureC },
+	"humidity":        func(m Measurement) *float64 { return m.HumidityPct },
+	"pressure":        func(m Measurement) *float64 { return m.PressureHPa },
+	"battery_voltage": func(m Measurement) *float64 { return m.BatteryV },
+}
+
+var alertActiveGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "alert_active",
+	Help: "Whether the alert rule is active for the tag, 1 if it is and 0 if it is not",
+}, append(tagLabels[:len(tagLabels):len(tagLabels)], "rule"))
+
+// alertRule fires when a value crosses its threshold, and clears once the
+// value is back past the clear threshold so that it doesn't flap around the
+// threshold.
+type alertRule struct {
+	// expr is the rule as written in the flag, without the MAC address.
+	expr string
+	// mac is the MAC address of the tag the rule applies to, any tag when empty.
+	mac   string
+	field string
+	// below is set when the rule fires under the threshold rather than over it.
+	below     bool
+	threshold float64
+	clear     float64
+}
+
+// parseAlertRules parses a comma-separated list of rules such as
+// CB:B8:33:4C:88:4F=temperature<2/3 or humidity>70/65: an optional MAC address
+// followed by =, a field, < or >, the threshold and an optional clear
+// threshold after a /, the threshold itself by default.
+func parseAlertRules(s string) ([]alertRule, error) {
+	var rules []alertRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		var rule alertRule
+		if mac, expr, ok := strings.Cut(r, "="); ok {
+			rule.mac = strings.ToUpper(strings.TrimSpace(mac))
+			if _, err := bluetooth.ParseMAC(rule.mac); err != nil {
+				return nil, fmt.Errorf("invalid MAC address in alert rule %q: %w", r, err)
+			}
+			r = strings.TrimSpace(expr)
+		}
+		rule.expr = r
+		i := strings.IndexAny(r, "<>")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid alert rule %q, want field<threshold or field>threshold", rule.expr)
+		}
+		rule.field, rule.below = strings.TrimSpace(r[:i]), r[i] == '<'
+		if _, ok := alertFields[rule.field]; !ok {
+			return nil, fmt.Errorf("unknown field %q in alert rule %q", rule.field, rule.expr)
+		}
+		threshold, clear, hasClear := strings.Cut(r[i+1:], "/")
+		var err error
+		if rule.threshold, err = strconv.ParseFloat(strings.TrimSpace(threshold), 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold in alert rule %q: %w", rule.expr, err)
+		}
+		rule.clear = rule.threshold
+		if hasClear {
+			if rule.clear, err = strconv.ParseFloat(strings.TrimSpace(clear), 64); err != nil {
+				return nil, fmt.Errorf("invalid clear threshold in alert rule %q: %w", rule.expr, err)
+			}
+		}
+		if rule.below && rule.clear < rule.threshold || !rule.below && rule.clear > rule.threshold {
+			return nil, fmt.Errorf("the clear threshold of alert rule %q must be on the other side of its threshold", rule.expr)
+		}
+		// The state of the rules is exported by expression, which must identify a single rule per tag.
+		for _, other := range rules {
+			if other.expr == rule.expr && (other.mac == rule.mac || other.mac == "" || rule.mac == "") {
+				return nil, fmt.Errorf("alert rule %q is given several times for the same tags", rule.expr)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// update returns whether the rule is active after value, given whether it was before.
+func (r alertRule) update(active bool, value float64) bool {
+	if r.below {
+		if active {
+			return value < r.clear
+		}
+		return value < r.threshold
+	}
+	if active {
+		return value > r.clear
+	}
+	return value > r.threshold
+}
+
+// alertEvent is the JSON body posted to the alert webhook.
+type alertEvent struct {
+	Rule string `json:"rule"`
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+	// Active is set when the alert fires and unset when it clears.
+	Active bool      `json:"active"`
+	Value  float64   `json:"value"`
+	Time   time.Time `json:"time"`
+}
+
+// alertKey identifies the state of a rule for a tag.
+type alertKey struct {
+	rule int
+	mac  string
+}
+
+// alerter evaluates alert rules against the measurements, exporting their
+// state and posting an event to a webhook when they fire or clear.
+type alerter struct {
+	rules []alertRule
+	// url is the webhook to post events to, none are posted when empty.
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	active map[alertKey]bool
+	// pending tracks the deliveries in progress so that close can wait for them.
+	pending sync.WaitGroup
+}
+
+func newAlerter(rules []alertRule, url string) *alerter {
+	return &alerter{
+		rules:  rules,
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		active: make(map[alertKey]bool),
+	}
+}
+
+// publish evaluates the rules applying to the tag of m.
+func (a *alerter) publish(m Measurement) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, rule := range a.rules {
+		if rule.mac != "" && rule.mac != m.MAC {
+			continue
+		}
+		value := alertFields[rule.field](m)
+		if value == nil {
+			continue
+		}
+		key := alertKey{rule: i, mac: m.MAC}
+		was := a.active[key]
+		active := rule.update(was, *value)
+		a.active[key] = active
+		gaugeValue := 0.0
+		if active {
+			gaugeValue = 1
+		}
+		alertActiveGauge.WithLabelValues(m.MAC, tagName(m.MAC), rule.expr).Set(gaugeValue)
+		if active == was {
+			continue
+		}
+		if active {
+			slog.Warn("Alert fired", "rule", rule.expr, "mac", m.MAC, "value", *value)
+		} else {
+			slog.Info("Alert cleared", "rule", rule.expr, "mac", m.MAC, "value", *value)
+		}
+		if a.url != "" {
+			a.notify(alertEvent{Rule: rule.expr, MAC: m.MAC, Name: tagName(m.MAC), Active: active, Value: *value, Time: now})
+		}
+	}
+}
+
+// notify posts e to the webhook in the background.
+func (a *alerter) notify(e alertEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Encoding alert event", "err", err)
+		return
+	}
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		if err := postWebhook(a.client, a.url, body); err != nil {
+			slog.Warn("Posting alert event", "rule", e.Rule, "mac", e.MAC, "attempts", webhookAttempts, "err", err)
+		}
+	}()
+}
+
+// close waits for the deliveries in progress.
+func (a *alerter) close() {
+	a.pending.Wait()
+}
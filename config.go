@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig sets the flags that were not given on the command line from the
+// YAML file at path. Its keys are flag names, lists are joined with commas and
+// mappings are written as comma-separated key=value pairs, e.g. for -names:
+//
+//	measure_every: 1m
+//	tags: [CB:B8:33:4C:88:4F]
+//	names:
+//	  CB:B8:33:4C:88:4F: garage
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]any
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	for name, value := range config {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q in %s", name, path)
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, flagValue(value)); err != nil {
+			return fmt.Errorf("setting %s from %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// flagValue formats a YAML value the way it would be given on the command line.
+func flagValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for key, item := range v {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", key, item))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var csvHeader = []string{"time", "mac", "name", "temperature", "humidity", "pressure", "battery_voltage", "rssi"}
+
+// csvWriter appends a row per measurement to a CSV file, which is rotated when
+// it grows past maxSize bytes or, if daily is set, on the first measurement of a day.
+type csvWriter struct {
+	path    string
+	maxSize int64
+	daily   bool
+
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+	// size is the size of the file in bytes.
+	size int64
+	// day is the day the rows of the file were written, as YYYY-MM-DD.
+	day string
+}
+
+// newCSVWriter opens the CSV file at path, writing the header if it is new.
+func newCSVWriter(path string, maxSize int64, daily bool) (*csvWriter, error) {
+	w := &csvWriter{path: path, maxSize: maxSize, daily: daily}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *csvWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.w, w.size = f, csv.NewWriter(f), info.Size()
+	w.day = info.ModTime().Format(time.DateOnly)
+	if w.size == 0 {
+		w.day = time.Now().Format(time.DateOnly)
+		return w.write(csvHeader)
+	}
+	return nil
+}
+
+// write appends record and flushes it so that at most the last row is lost on power loss.
+func (w *csvWriter) write(record []string) error {
+	if err := w.w.Write(record); err != nil {
+		return err
+	}
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		return err
+	}
+	// Stat the file rather than counting bytes to account for csv quoting.
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	w.size = info.Size()
+	return nil
+}
+
+// rotate renames the file with the time of the rotation as suffix and opens a new one.
+func (w *csvWriter) rotate(now time.Time) error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, fmt.Sprintf("%s.%s", w.path, now.Format("20060102-150405"))); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *csvWriter) publish(m Measurement) {
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		// Reopening the file failed after a rotation, retry.
+		if err := w.open(); err != nil {
+			slog.Warn("Opening CSV file", "path", w.path, "err", err)
+			return
+		}
+	}
+	if (w.maxSize > 0 && w.size >= w.maxSize) || (w.daily && w.day != now.Format(time.DateOnly)) {
+		if err := w.rotate(now); err != nil {
+			w.f = nil
+			slog.Warn("Rotating CSV file", "path", w.path, "err", err)
+			return
+		}
+	}
+	formatFloat := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	record := []string{
+		now.Format(time.RFC3339),
+		m.MAC,
+		tagName(m.MAC),
+		formatFloat(m.TemperatureC),
+		formatFloat(m.HumidityPct),
+		formatFloat(m.PressureHPa),
+		formatFloat(m.BatteryV),
+		strconv.Itoa(int(m.RSSI)),
+	}
+	if err := w.write(record); err != nil {
+		slog.Warn("Writing to CSV file", "path", w.path, "err", err)
+	}
+}
+
+// close closes the file.
+func (w *csvWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import "math"
+
+// Magnus formula coefficients, valid from -45°C to 60°C.
+// https://en.wikipedia.org/wiki/Dew_point#Calculating_the_dew_point
+const (
+	magnusB = 17.62
+	magnusC = 243.12 // °C
+)
+
+// dewPointC returns the dew point in celsius given a temperature in celsius and
+// a relative humidity in percent, or NaN when the humidity is not positive.
+func dewPointC(tempC, humidityPct float64) float64 {
+	if humidityPct <= 0 {
+		return math.NaN()
+	}
+	gamma := math.Log(humidityPct/100) + magnusB*tempC/(magnusC+tempC)
+	return magnusC * gamma / (magnusB - gamma)
+}
+
+// absoluteHumidity returns the water vapor density in g/m³ given a temperature
+// in celsius and a relative humidity in percent.
+// https://carnotcycle.wordpress.com/2012/08/04/how-to-convert-relative-humidity-to-absolute-humidity/
+func absoluteHumidity(tempC, humidityPct float64) float64 {
+	saturationVaporPressure := 6.112 * math.Exp(17.67*tempC/(tempC+243.5)) // hPa
+	return saturationVaporPressure * humidityPct * 2.1674 / (273.15 + tempC)
+}
+
+// batteryCurve maps the voltage of the CR2477 coin cell powering the tags to
+// its remaining capacity, from the highest to the lowest voltage.
+var batteryCurve = []struct{ voltage, percent float64 }{
+	{3.0, 100},
+	{2.5, 20},
+	{2.0, 0},
+}
+
+// batteryPercent estimates the remaining battery capacity in percent from its
+// voltage, interpolating linearly along batteryCurve and clamping to [0,100].
+func batteryPercent(voltage float64) float64 {
+	if voltage >= batteryCurve[0].voltage {
+		return batteryCurve[0].percent
+	}
+	for i := 1; i < len(batteryCurve); i++ {
+		hi, lo := batteryCurve[i-1], batteryCurve[i]
+		if voltage >= lo.voltage {
+			return lo.percent + (voltage-lo.voltage)*(hi.percent-lo.percent)/(hi.voltage-lo.voltage)
+		}
+	}
+	return 0
+}
+
+// accelerationMagnitude returns the norm of the acceleration vector, about
+// 1000 milli-g at rest.
+func accelerationMagnitude(x, y, z float64) float64 {
+	return math.Sqrt(x*x + y*y + z*z)
+}
+
+// tiltDegrees returns the angle in degrees between the acceleration vector
+// and the Z axis, which is vertical when the tag lies flat and at rest, or
+// NaN without acceleration.
+func tiltDegrees(x, y, z float64) float64 {
+	magnitude := accelerationMagnitude(x, y, z)
+	if magnitude == 0 {
+		return math.NaN()
+	}
+	return math.Acos(z/magnitude) * 180 / math.Pi
+}
+
+// saturationVaporPressureKPa returns the saturation vapor pressure of water in
+// kPa at a temperature in celsius, with the Tetens equation.
+// https://en.wikipedia.org/wiki/Tetens_equation
+func saturationVaporPressureKPa(tempC float64) float64 {
+	return 0.6108 * math.Exp(17.27*tempC/(tempC+237.3))
+}
+
+// vaporPressureDeficitKPa returns the vapor pressure deficit in kPa of leaves
+// at leafOffsetC from the air temperature in celsius, given the relative
+// humidity of the air in percent.
+func vaporPressureDeficitKPa(tempC, humidityPct, leafOffsetC float64) float64 {
+	return saturationVaporPressureKPa(tempC+leafOffsetC) - saturationVaporPressureKPa(tempC)*humidityPct/100
+}
+
+// heatIndexC returns the heat index in celsius, the temperature felt given a
+// temperature in celsius and a relative humidity in percent, with the
+// algorithm of the US National Weather Service.
+// https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml
+func heatIndexC(tempC, humidityPct float64) float64 {
+	t := fahrenheit(tempC) // the regressions are in fahrenheit
+	rh := humidityPct
+	// Steadman's simpler formula is used below 80°F, where it is accurate enough.
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+			6.83783e-3*t*t - 5.481717e-2*rh*rh + 1.22874e-3*t*t*rh +
+			8.5282e-4*t*rh*rh - 1.99e-6*t*t*rh*rh
+		switch {
+		case rh < 13 && t >= 80 && t <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case rh > 85 && t >= 80 && t <= 87:
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// batteryLowThreshold returns the voltage under which a battery is low given
+// its threshold at room temperature and the temperature in celsius. The
+// voltage of coin cells sags in the cold, so the threshold is lowered below
+// freezing like the Ruuvi Station app does.
+func batteryLowThreshold(thresholdV, tempC float64) float64 {
+	switch {
+	case tempC <= -20:
+		return thresholdV - 0.5
+	case tempC < 0:
+		return thresholdV - 0.2
+	default:
+		return thresholdV
+	}
+}
+
+// fahrenheit converts a temperature in celsius to fahrenheit.
+func fahrenheit(tempC float64) float64 {
+	return tempC*9/5 + 32
+}
+
+// inchesOfMercury converts a pressure in hPa to inches of mercury.
+func inchesOfMercury(pressureHPa float64) float64 {
+	return pressureHPa * 0.0295299830714
+}
+
+// maxGravityDeviation is how far in milli-g the magnitude of the acceleration
+// can be from 1g for the orientation of a tag to be derived from it.
+const maxGravityDeviation = 500
+
+// pitchRollDegrees returns the pitch and roll angles in degrees of a tag from
+// its acceleration in milli-g, both 0 when the tag lies flat. Pitch is the
+// rotation around the Y axis, positive when the X axis points up, and roll the
+// rotation around the X axis, positive when the Y axis points up. ok is false
+// when the acceleration is too far from gravity alone for the angles to be
+// meaningful, e.g. in free fall or while shaken.
+func pitchRollDegrees(x, y, z float64) (pitch, roll float64, ok bool) {
+	if math.Abs(accelerationMagnitude(x, y, z)-1000) > maxGravityDeviation {
+		return 0, 0, false
+	}
+	pitch = math.Atan2(x, math.Sqrt(y*y+z*z)) * 180 / math.Pi
+	roll = math.Atan2(y, z) * 180 / math.Pi
+	return pitch, roll, true
+}
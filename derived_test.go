@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDerived(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  float64
+		// want is NaN when no value can be derived.
+		want float64
+	}{
+		{"dew point", dewPointC(20, 50), 9.26},
+		{"dew point below freezing", dewPointC(-10, 80), -12.80},
+		{"dew point of saturated air", dewPointC(20, 100), 20},
+		{"dew point of dry air", dewPointC(20, 0), math.NaN()},
+		{"absolute humidity", absoluteHumidity(20, 50), 8.64},
+		{"absolute humidity of saturated air", absoluteHumidity(30, 100), 30.35},
+		{"absolute humidity of dry air", absoluteHumidity(20, 0), 0},
+		{"battery full", batteryPercent(3.0), 100},
+		{"battery above full", batteryPercent(3.2), 100},
+		{"battery half way along the curve", batteryPercent(2.75), 60},
+		{"battery low", batteryPercent(2.5), 20},
+		{"battery almost empty", batteryPercent(2.25), 10},
+		{"battery below empty", batteryPercent(1.9), 0},
+		{"acceleration at rest", accelerationMagnitude(0, 0, 1000), 1000},
+		{"acceleration along several axes", accelerationMagnitude(600, 0, -800), 1000},
+		{"tilt lying flat", tiltDegrees(0, 0, 1000), 0},
+		{"tilt on its side", tiltDegrees(1000, 0, 0), 90},
+		{"tilt upside down", tiltDegrees(0, 0, -1000), 180},
+		{"tilt without acceleration", tiltDegrees(0, 0, 0), math.NaN()},
+		{"saturation vapor pressure", saturationVaporPressureKPa(25), 3.17},
+		{"vapor pressure deficit", vaporPressureDeficitKPa(25, 50, 0), 1.58},
+		{"vapor pressure deficit of cooler leaves", vaporPressureDeficitKPa(25, 50, -2), 1.23},
+		{"vapor pressure deficit of saturated air", vaporPressureDeficitKPa(25, 100, 0), 0},
+		{"vapor pressure deficit of dry air", vaporPressureDeficitKPa(25, 0, 0), 3.17},
+		{"heat index of a mild day", heatIndexC(20, 50), 19.36},
+		{"heat index of a humid day", heatIndexC(32, 70), 40.41},
+		{"heat index of a dry day", heatIndexC(40, 10), 36.71},
+		{"heat index of saturated air", heatIndexC(30, 100), 44.36},
+		{"heat index of dry air", heatIndexC(20, 0), 18.06},
+		{"pitch lying flat", pitch(0, 0, 1000), 0},
+		{"pitch with the x axis up", pitch(1000, 0, 0), 90},
+		{"pitch with the x axis down", pitch(-1000, 0, 0), -90},
+		{"pitch half way up", pitch(707, 0, 707), 45},
+		{"roll lying flat", roll(0, 0, 1000), 0},
+		{"roll with the y axis up", roll(0, 1000, 0), 90},
+		{"roll upside down", roll(0, 0, -1000), 180},
+		{"pitch in free fall", pitch(0, 0, 0), math.NaN()},
+		{"roll while shaken", roll(0, 0, 2000), math.NaN()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			switch {
+			case math.IsNaN(tc.want):
+				if !math.IsNaN(tc.got) {
+					t.Errorf("got %v, want NaN", tc.got)
+				}
+			case math.IsNaN(tc.got) || math.Abs(tc.got-tc.want) > 0.01:
+				t.Errorf("got %v, want %v", tc.got, tc.want)
+			}
+		})
+	}
+}
+
+// pitch and roll return the angles of pitchRollDegrees, or NaN when they are not reported.
+func pitch(x, y, z float64) float64 {
+	pitch, _, ok := pitchRollDegrees(x, y, z)
+	if !ok {
+		return math.NaN()
+	}
+	return pitch
+}
+
+func roll(x, y, z float64) float64 {
+	_, roll, ok := pitchRollDegrees(x, y, z)
+	if !ok {
+		return math.NaN()
+	}
+	return roll
+}
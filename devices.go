@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// printDevices scans with s for the given duration and prints every device seen
+// to w, along with the Ruuvi data format it advertises if any, to help finding
+// the tags to measure.
+func printDevices(s Scanner, w io.Writer, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	stopOnDone := context.AfterFunc(ctx, func() { stopScan(s) })
+	defer stopOnDone()
+	devices := make(map[string]bluetooth.ScanResult)
+	if err := s.Scan(func(device bluetooth.ScanResult) {
+		devices[device.Address.String()] = device
+	}); err != nil {
+		return fmt.Errorf("%w: %w", errScan, err)
+	}
+
+	addresses := make([]string, 0, len(devices))
+	for address := range devices {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tRSSI\tNAME\tMANUFACTURER IDS\tRUUVI FORMAT")
+	for _, address := range addresses {
+		device := devices[address]
+		var ids []string
+		for _, id := range manufacturerIDs(device.ManufacturerData()) {
+			ids = append(ids, fmt.Sprintf("0x%04X", id))
+		}
+		format := "-"
+		if payload, ok := findPayload(device.ManufacturerData(), device.Bytes()); ok && len(payload) > 0 {
+			format = fmt.Sprint(payload[0])
+			if _, ok := dataFormats[payload[0]]; !ok {
+				format += " (unsupported)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", address, device.RSSI, device.LocalName(), strings.Join(ids, ","), format)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	// eddystoneUUID is the 16-bit UUID of the service data carrying Eddystone frames.
+	eddystoneUUID = 0xFEAA
+	// eddystoneURLFrame is the frame type of the Eddystone-URL frames.
+	eddystoneURLFrame = 0x10
+	// eddystoneURLPayloadLen is the length of the base64 encoded sensor data in
+	// URLs, Data format 4 appends a character holding a random tag ID.
+	eddystoneURLPayloadLen = 8
+)
+
+// eddystonePayload extracts the sensor data of Data formats 2 and 4 from the
+// Eddystone-URL frame in serviceData, whose URL is like
+// https://ruu.vi/#BEAYAMRA with the data base64 encoded after the #. Like any
+// service data, the frames are only found in relayed advertisements, see serviceData.
+// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/dataformat_04.md
+func eddystonePayload(serviceData []byte) ([]byte, bool) {
+	// Frame type, TX power, URL scheme prefix and the encoded URL.
+	if len(serviceData) < 4 || serviceData[0] != eddystoneURLFrame {
+		return nil, false
+	}
+	_, encoded, ok := strings.Cut(string(serviceData[3:]), "#")
+	if !ok || len(encoded) < eddystoneURLPayloadLen {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded[:eddystoneURLPayloadLen])
+	if err != nil || (payload[0] != 2 && payload[0] != 4) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// parseEddystone decodes the sensor data of a Data format 2 or 4 packet,
+// which only carries the humidity, temperature and pressure.
+// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/dataformat_02.md
+func parseEddystone(buf []byte) (Measurement, error) {
+	var m Measurement
+	parseWeather(buf, &m)
+	return m, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// ErrEncrypted is returned for encrypted packets of tags that have no decryption key.
+var ErrEncrypted = fmt.Errorf("%w: encrypted packet without a key", ErrUnsupportedFormat)
+
+// parseKeys parses a comma-separated list of MAC=key pairs, keys being 128-bit AES keys in hexadecimal.
+func parseKeys(s string) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		mac, key, ok := strings.Cut(entry, "=")
+		mac = strings.ToUpper(strings.TrimSpace(mac))
+		if !ok {
+			return nil, fmt.Errorf("invalid entry for %s, want MAC=key", mac)
+		}
+		if _, err := bluetooth.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q: %w", mac, err)
+		}
+		// The key is not part of the errors so that it doesn't end up in the logs.
+		k, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil || len(k) != 16 {
+			return nil, fmt.Errorf("invalid key for %s, want 32 hexadecimal digits", mac)
+		}
+		m[mac] = k
+	}
+	return m, nil
+}
+
+// parseFormat8 decodes a Data format 8 packet, whose fields are encrypted
+// with the AES-128 key of the tag and followed by a CRC8 and the mac address.
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-8-encrypted-environmental
+func parseFormat8(buf []byte) (Measurement, error) {
+	var m Measurement
+	m.MAC = formatMAC(buf[18:24])
+	key, ok := encryptionKeys[m.MAC]
+	if !ok {
+		return m, ErrEncrypted
+	}
+	encrypted := buf[1:17]
+	if got, want := crc8(encrypted), buf[17]; got != want {
+		return m, fmt.Errorf("CRC mismatch: got %#02x, want %#02x", got, want)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return m, err
+	}
+	// The payload is a single block encrypted in ECB mode.
+	data := make([]byte, aes.BlockSize)
+	block.Decrypt(data, encrypted)
+
+	// The fields are laid out as in Data format 5, without the acceleration.
+	parseEnvironment(data[0:6], &m)
+	parsePowerInfo(data[6:8], &m)
+	parseCounters(data[8:11], &m)
+	return m, nil
+}
+
+// crc8 computes the CRC-8 of data with the polynomial 0x07 and an initial value of 0.
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gatewayRequest is the body of the requests made by a Ruuvi Gateway relaying
+// advertisements over HTTP.
+// https://docs.ruuvi.com/gw-data-formats/http-time-stamped-data-from-bluetooth-sensors
+type gatewayRequest struct {
+	Data struct {
+		GatewayMAC string `json:"gw_mac"`
+		Tags       map[string]struct {
+			RSSI int16 `json:"rssi"`
+			// Data is the hex encoded raw advertisement.
+			Data string `json:"data"`
+		} `json:"tags"`
+	} `json:"data"`
+}
+
+// gatewayHandler processes the advertisements relayed by Ruuvi Gateways as if
+// they had been received by the local adapter.
+type gatewayHandler struct {
+	// mu serializes the processing of packets from concurrent requests.
+	mu sync.Mutex
+}
+
+func (h *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var req gatewayRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for mac, tag := range req.Data.Tags {
+		mac = strings.ToUpper(mac)
+		// Like isTag, the allowed tags are measured whatever their RSSI.
+		if len(allowedTags) > 0 {
+			if !allowedTags[mac] {
+				continue
+			}
+		} else if *minRSSI != 0 && int(tag.RSSI) < *minRSSI {
+			continue
+		}
+		raw, err := hex.DecodeString(tag.Data)
+		if err != nil {
+			slog.Warn("Invalid advertisement from gateway", "gateway", req.Data.GatewayMAC, "mac", mac, "err", err)
+			continue
+		}
+		payload, ok := findPayload(manufacturerData(raw), raw)
+		if !ok {
+			continue
+		}
+		err = processPacket(mac, tag.RSSI, payload)
+		if errors.Is(err, errDuplicate) || errors.Is(err, errThrottled) {
+			continue
+		}
+		if err != nil {
+			slog.Warn("Measurement failed", "gateway", req.Data.GatewayMAC, "mac", mac, "err", err)
+		} else {
+			packetsReceived.Add(1)
+		}
+		recordMeasurement(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
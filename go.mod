@@ -2,16 +2,24 @@ module github.com/attwad/ruuvi
 
 go 1.21
 
-require tinygo.org/x/bluetooth v0.7.0
+require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/prometheus/client_model v0.4.0
+	gopkg.in/yaml.v3 v3.0.1
+	tinygo.org/x/bluetooth v0.7.0
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
-	github.com/prometheus/client_model v0.4.0 // indirect
 	github.com/prometheus/common v0.44.0 // indirect
 	github.com/prometheus/procfs v0.11.1 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 )
 
@@ -19,7 +27,7 @@ require (
 	github.com/fatih/structs v1.1.0 // indirect
 	github.com/go-ole/go-ole v1.3.0 // indirect
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
-	github.com/muka/go-bluetooth v0.0.0-20221213043340-85dc80edc4e1 // indirect
+	github.com/muka/go-bluetooth v0.0.0-20221213043340-85dc80edc4e1
 	github.com/prometheus/client_golang v1.16.0
 	github.com/saltosystems/winrt-go v0.0.0-20230710111611-a39229b5054c // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reading is a measurement along with the time it was received.
+type reading struct {
+	Measurement Measurement `json:"measurement"`
+	Time        time.Time   `json:"time"`
+}
+
+// latestReadings holds the most recent reading of each tag, it is a publisher
+// so that it is updated with every measurement.
+type latestReadings struct {
+	mu       sync.Mutex
+	readings map[string]reading
+}
+
+func (l *latestReadings) publish(m Measurement) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readings[m.MAC] = reading{Measurement: m, Time: time.Now()}
+}
+
+func (l *latestReadings) close() {}
+
+// forget deletes the reading of the tag with the given MAC address.
+func (l *latestReadings) forget(mac string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.readings, mac)
+}
+
+// ServeHTTP writes the latest readings as a JSON object keyed by MAC address.
+func (l *latestReadings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	body, err := json.Marshal(l.readings)
+	l.mu.Unlock()
+	if err != nil {
+		slog.Error("Encoding latest readings", "err", err)
+		http.Error(w, "encoding latest readings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// rawPacket is the raw payload of a packet along with its format and the time it was received.
+type rawPacket struct {
+	Payload string `json:"payload"`
+	Format  int    `json:"format"`
+	// MAC is the address of the tag found in the packet, empty until it is parsed.
+	MAC  string    `json:"mac,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// rawPackets holds the last packet received from each address, to debug decoding remotely.
+type rawPackets struct {
+	mu      sync.Mutex
+	packets map[string]rawPacket
+}
+
+// record stores buf as the last packet of address, its format is -1 when it is empty.
+func (r *rawPackets) record(address string, buf []byte) {
+	p := rawPacket{Payload: hex.EncodeToString(buf), Format: -1, Time: time.Now()}
+	if len(buf) > 0 {
+		p.Format = int(buf[0])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets[address] = p
+}
+
+// parsed records that the last packet of address was parsed into a
+// measurement of the tag with the given MAC address.
+func (r *rawPackets) parsed(address, mac string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.packets[address]; ok {
+		p.MAC = mac
+		r.packets[address] = p
+	}
+}
+
+// forget deletes the last packets of the tag with the given MAC address,
+// whatever the addresses they were advertised from.
+func (r *rawPackets) forget(mac string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for address, p := range r.packets {
+		if p.MAC == mac {
+			delete(r.packets, address)
+		}
+	}
+}
+
+// ServeHTTP writes the last packets as a JSON object keyed by address.
+func (r *rawPackets) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	body, err := json.Marshal(r.packets)
+	r.mu.Unlock()
+	if err != nil {
+		slog.Error("Encoding raw packets", "err", err)
+		http.Error(w, "encoding raw packets", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// indexPage is the landing page served on /, the conventional one of exporters.
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Ruuvi exporter</title></head>
+<body>
+<h1>Ruuvi exporter</h1>
+<p>{{.Version}}</p>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+</body>
+</html>
+`))
+
+// indexHandler serves the landing page linking to the metrics served on metricsPath.
+func indexHandler(metricsPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mux routes every unknown path here.
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := indexPage.Execute(w, struct{ Version, MetricsPath string }{versionString(), metricsPath}); err != nil {
+			slog.Warn("Writing index page", "err", err)
+		}
+	})
+}
+
+// healthzHandler reports whether the exporter is alive: the adapter must be
+// enabled and the last measurements must not all have failed.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !adapterEnabled.Load() {
+		http.Error(w, "bluetooth adapter not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	if n := consecutiveFailures.Load(); *unhealthyAfter > 0 && n >= int64(*unhealthyAfter) {
+		http.Error(w, fmt.Sprintf("last %d measurements failed", n), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports the exporter as ready once a measurement succeeded.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "no successful measurement yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// requireAuth wraps next so that requests are rejected with 401 unless they
+// carry the bearer token or the basic auth credentials set by the flags.
+// Requests are let through when neither is set.
+func requireAuth(next http.Handler) http.Handler {
+	if *metricsAuthToken == "" && *metricsBasicUser == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if *metricsBasicUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ruuvi"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// authorized reports whether r carries valid credentials, comparing them in constant time.
+func authorized(r *http.Request) bool {
+	if *metricsAuthToken != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, *metricsAuthToken) {
+			return true
+		}
+	}
+	if *metricsBasicUser != "" {
+		if user, pass, ok := r.BasicAuth(); ok && secureEqual(user, *metricsBasicUser) && secureEqual(pass, *metricsBasicPass) {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
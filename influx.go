@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxInfluxBuffer is the maximum number of points kept while InfluxDB is
+// unreachable, the oldest points are dropped beyond it.
+const maxInfluxBuffer = 10000
+
+// influxWriter batches measurements as line protocol points and writes them
+// to the InfluxDB v1 or v2 HTTP API on a timer.
+type influxWriter struct {
+	writeURL string
+	// authorize sets the credentials of the write requests.
+	authorize func(*http.Request)
+	client    *http.Client
+
+	mu    sync.Mutex
+	lines []string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newInfluxWriter returns a writer flushing points to the given bucket every flushEvery.
+func newInfluxWriter(serverURL, org, bucket, token string, flushEvery time.Duration) (*influxWriter, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing InfluxDB URL: %w", err)
+	}
+	u = u.JoinPath("api/v2/write")
+	u.RawQuery = url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ns"}}.Encode()
+	return startInfluxWriter(u.String(), func(req *http.Request) {
+		req.Header.Set("Authorization", "Token "+token)
+	}, flushEvery), nil
+}
+
+// newInfluxV1Writer returns a writer flushing points to the given database and
+// retention policy of an InfluxDB 1.x server every flushEvery, authenticating
+// with basic auth when user is set. The default retention policy is used when
+// retentionPolicy is empty.
+func newInfluxV1Writer(serverURL, database, retentionPolicy, user, password string, flushEvery time.Duration) (*influxWriter, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing InfluxDB URL: %w", err)
+	}
+	u = u.JoinPath("write")
+	q := url.Values{"db": {database}, "precision": {"ns"}}
+	if retentionPolicy != "" {
+		q.Set("rp", retentionPolicy)
+	}
+	u.RawQuery = q.Encode()
+	return startInfluxWriter(u.String(), func(req *http.Request) {
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+	}, flushEvery), nil
+}
+
+func startInfluxWriter(writeURL string, authorize func(*http.Request), flushEvery time.Duration) *influxWriter {
+	w := &influxWriter{
+		writeURL:  writeURL,
+		authorize: authorize,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go w.run(flushEvery)
+	return w
+}
+
+// publish queues m for the next flush.
+func (w *influxWriter) publish(m Measurement) {
+	line := lineProtocol(m, time.Now())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(w.lines, line)
+	if n := len(w.lines) - maxInfluxBuffer; n > 0 {
+		slog.Warn("InfluxDB buffer full, dropping oldest points", "dropped", n)
+		w.lines = w.lines[n:]
+	}
+}
+
+func (w *influxWriter) run(flushEvery time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			w.flush()
+			return
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+// flush writes the queued points, they are queued again to be retried on failure.
+func (w *influxWriter) flush() {
+	w.mu.Lock()
+	lines := w.lines
+	w.lines = nil
+	w.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	if err := w.write(lines); err != nil {
+		slog.Warn("Writing to InfluxDB, will retry", "points", len(lines), "err", err)
+		w.mu.Lock()
+		w.lines = append(lines, w.lines...)
+		w.mu.Unlock()
+	}
+}
+
+func (w *influxWriter) write(lines []string) error {
+	req, err := http.NewRequest(http.MethodPost, w.writeURL, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	w.authorize(req)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// close flushes the queued points and stops the writer.
+func (w *influxWriter) close() {
+	close(w.stop)
+	<-w.done
+}
+
+// lineProtocol formats m as an InfluxDB line protocol point of the ruuvi
+// measurement, tagged by the MAC address and name of its tag.
+func lineProtocol(m Measurement, t time.Time) string {
+	var fields []string
+	addFloat := func(key string, v *float64) {
+		if v != nil {
+			fields = append(fields, key+"="+strconv.FormatFloat(*v, 'f', -1, 64))
+		}
+	}
+	addInt := func(key string, v int64) {
+		fields = append(fields, key+"="+strconv.FormatInt(v, 10)+"i")
+	}
+	addFloat("temperature", m.TemperatureC)
+	addFloat("humidity", m.HumidityPct)
+	addFloat("pressure", m.PressureHPa)
+	addFloat("battery_voltage", m.BatteryV)
+	for _, axis := range []struct {
+		key   string
+		value *int16
+	}{{"acceleration_x", m.AccelX}, {"acceleration_y", m.AccelY}, {"acceleration_z", m.AccelZ}} {
+		if axis.value != nil {
+			addInt(axis.key, int64(*axis.value))
+		}
+	}
+	if m.TxPowerDBm != nil {
+		addInt("tx_power", int64(*m.TxPowerDBm))
+	}
+	if m.MovementCount != nil {
+		addInt("movement_counter", int64(*m.MovementCount))
+	}
+	if m.SequenceNumber != nil {
+		addInt("measurement_sequence", int64(*m.SequenceNumber))
+	}
+	addInt("rssi", int64(m.RSSI))
+	return fmt.Sprintf("ruuvi,mac=%s,name=%s %s %d", escapeTag(m.MAC), escapeTag(tagName(m.MAC)), strings.Join(fields, ","), t.UnixNano())
+}
+
+// tagEscaper escapes the characters that are special in line protocol tag keys and values.
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
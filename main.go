@@ -2,12 +2,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,160 +31,1802 @@ import (
 	"tinygo.org/x/bluetooth"
 )
 
+// metricPrefixRE matches the valid prefixes of metric names.
+var metricPrefixRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// tagLabels are the labels identifying the tag of each per-tag metric.
+var tagLabels = []string{"mac", "name"}
+
 var (
-	adapter         = bluetooth.DefaultAdapter
+	// scanner scans with the default adapter, the one selected with the adapter flag.
+	scanner         = Scanner(adapterScanner{adapter: bluetooth.DefaultAdapter})
 	numMeasurements = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "measurement_count",
+			Help: "Number of successful measurements",
 		},
 	)
 	numMeasurementsErrs = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "measurement_err_count",
+			Help: "Number of failed measurements, because of a scan error, no tag being found or a packet that could not be parsed",
+		},
+	)
+	numMeasurementErrsByReason = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "measurement_errors_total",
+			Help: "Number of failed measurements by reason: timeout, scan_error, not_found, length_mismatch, parse_error or other",
+		},
+		[]string{"reason"},
+	)
+	numAdapterReenables = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "adapter_reenable_count",
+			Help: "Number of attempts to power-cycle the BLE adapter after repeated failed scans or measurements finding no tag",
+		},
+	)
+	lastSuccessGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "last_successful_cycle_timestamp_seconds",
+			Help: "Unix time of the last successful measurement, or of the last packet processed in continuous mode",
+		},
+	)
+	measureIntervalGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "measure_interval_seconds",
+			Help: "Configured interval between measurements, the shortest of measure_every and tag_intervals",
+		},
+	)
+	scanWindowGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "scan_window_seconds",
+			Help: "Configured duration of the scan of each measurement, scan_window",
+		},
+	)
+	tagsSeenGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tags_seen",
+			Help: "Number of distinct tags seen during the last measurement, or during the last measure_every in continuous mode",
 		},
 	)
-	tempGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	numUnsupportedFormats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "unsupported_format_count",
+			Help: "Number of packets received in a data format that cannot be decoded",
+		},
+		[]string{"format"},
+	)
+	numPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "packets_total",
+			Help: "Number of packets processed by data format and result: ok, invalid, unsupported, encrypted, duplicate or throttled",
+		},
+		[]string{"format", "result"},
+	)
+	numInvalidReadings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "invalid_reading_count",
+			Help: "Number of sensor readings reported as not available by the tag",
+		},
+	)
+	tempGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "temperature",
 		Help: "Temperature in celcius",
-	})
-	humidityGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, tagLabels)
+	// The imperial gauges are only set with imperial units.
+	tempFahrenheitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "temperature_fahrenheit",
+		Help: "Temperature in fahrenheit",
+	}, tagLabels)
+	pressureInHgGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pressure_inhg",
+		Help: "Pressure in inches of mercury",
+	}, tagLabels)
+	humidityGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "humidity",
 		Help: "Humidity in percentage",
-	})
-	pressureGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, tagLabels)
+	pressureGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "pressure",
 		Help: "Atmospheric pressure in hectopascal",
+	}, tagLabels)
+	accelerationXGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "acceleration_x",
+		Help: "Acceleration on the X axis in milli-g",
+	}, tagLabels)
+	accelerationYGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "acceleration_y",
+		Help: "Acceleration on the Y axis in milli-g",
+	}, tagLabels)
+	accelerationZGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "acceleration_z",
+		Help: "Acceleration on the Z axis in milli-g",
+	}, tagLabels)
+	accelerationTotalGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "acceleration_total",
+		Help: "Magnitude of the acceleration in milli-g, about 1000 at rest",
+	}, tagLabels)
+	tiltGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tilt",
+		Help: "Whether the tag is tilted from vertical by more than the tilt angle, 1 if it is and 0 if it is not",
+	}, tagLabels)
+	pitchGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pitch_degrees",
+		Help: "Rotation of the tag around its Y axis in degrees, positive when its X axis points up, derived from the acceleration",
+	}, tagLabels)
+	rollGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "roll_degrees",
+		Help: "Rotation of the tag around its X axis in degrees, positive when its Y axis points up, derived from the acceleration",
+	}, tagLabels)
+	batteryVoltageGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "battery_voltage",
+		Help: "Battery voltage in volts",
+	}, tagLabels)
+	batteryPercentGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "battery_percent",
+		Help: "Estimated remaining battery capacity in percent, derived from the battery voltage",
+	}, tagLabels)
+	batteryLowGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "battery_low",
+		Help: "Whether the battery should be replaced, 1 if its voltage is under the battery low voltage lowered for the cold and 0 if it is not",
+	}, tagLabels)
+	txPowerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tx_power_dbm",
+		Help: "Transmit power in dBm the tag advertises with, the rssi is how much of it is received",
+	}, tagLabels)
+	// The movement counter is maintained by the tag and wraps around at 255, so
+	// it is set as a gauge rather than being a Prometheus counter: use
+	// changes() or delta() to graph activity instead of rate().
+	movementCounterGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "movement_counter",
+		Help: "Number of movements detected by the accelerometer, wraps at 255",
+	}, tagLabels)
+	measurementSequenceGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "measurement_sequence",
+		Help: "Measurement sequence number of the last received packet",
+	}, tagLabels)
+	temperatureMinGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "temperature_min",
+		Help: "Lowest temperature in celsius over the stats window",
+	}, tagLabels)
+	temperatureMaxGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "temperature_max",
+		Help: "Highest temperature in celsius over the stats window",
+	}, tagLabels)
+	humidityMinGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "humidity_min",
+		Help: "Lowest humidity in percentage over the stats window",
+	}, tagLabels)
+	humidityMaxGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "humidity_max",
+		Help: "Highest humidity in percentage over the stats window",
+	}, tagLabels)
+	temperatureTrendGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "temperature_trend_celsius_per_hour",
+		Help: "Rate of change of the temperature in celsius per hour, fitted on the recent readings",
+	}, tagLabels)
+	dewPointGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dew_point",
+		Help: "Dew point in celsius, derived from the temperature and humidity",
+	}, tagLabels)
+	absoluteHumidityGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "absolute_humidity",
+		Help: "Absolute humidity in grams per cubic meter, derived from the temperature and humidity",
+	}, tagLabels)
+	vpdGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpd_kpa",
+		Help: "Vapor pressure deficit in kilopascal, derived from the temperature and humidity",
+	}, tagLabels)
+	heatIndexGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "heat_index_celsius",
+		Help: "Temperature felt in celsius, derived from the temperature and humidity",
+	}, tagLabels)
+	rssiGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rssi",
+		Help: "Received signal strength indicator of the last packet in dBm",
+	}, tagLabels)
+	lastSeenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "last_seen_timestamp_seconds",
+		Help: "Unix timestamp of the last valid packet received from the tag",
+	}, tagLabels)
+	tagUpGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tag_up",
+		Help: "Whether the tag was seen during the last measurement, 1 if it was and 0 if it was not",
+	}, tagLabels)
+	// tagGauges are all the gauges holding a series per tag.
+	tagGauges = []*prometheus.GaugeVec{tempGauge, tempFahrenheitGauge, humidityGauge, pressureGauge, pressureInHgGauge, dewPointGauge, absoluteHumidityGauge, vpdGauge, heatIndexGauge, accelerationXGauge, accelerationYGauge, accelerationZGauge, accelerationTotalGauge, tiltGauge, pitchGauge, rollGauge, batteryVoltageGauge, batteryPercentGauge, batteryLowGauge, txPowerGauge, movementCounterGauge, measurementSequenceGauge, rssiGauge, lastSeenGauge, tagUpGauge, temperatureMinGauge, temperatureMaxGauge, humidityMinGauge, humidityMaxGauge, temperatureTrendGauge}
+	// registry holds the exported metrics, served along with the Go and process
+	// metrics of the default registry but pushed and written on their own.
+	registry = prometheus.NewRegistry()
+	// measureTime and scanTime are created once the buckets are parsed from the duration_buckets flag.
+	measureTime prometheus.Histogram
+	scanTime    prometheus.Histogram
+	parseTime   = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "parse_duration_seconds",
+		Help:    "Seconds it took to decode a packet",
+		Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
 	})
-	measureTime = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "measurement_duration",
-		Help:    "Seconds it took to make a measurement",
-		Buckets: prometheus.LinearBuckets(1, 5, 20),
-	})
 
-	measureEvery = flag.Duration("measure_every", 5*time.Minute, "Get measurements once every specified duration")
-	addr         = flag.String("addr", "127.0.0.1:8045", "address:port to listen on")
+	// lastExported holds the time the last measurement of each tag was exported, guarded by lastSeenMu.
+	lastExported = make(map[string]time.Time)
+
+	// lastSequences holds the sequence number of the previously parsed packet of each tag, guarded by lastSeenMu.
+	lastSequences = make(map[string]int)
+
+	// lastSeen holds the time the last valid packet of each tag was received, guarded by lastSeenMu.
+	lastSeen   = make(map[string]time.Time)
+	lastSeenMu sync.Mutex
+
+	// adapterEnabled is set once the BLE adapter has been enabled.
+	adapterEnabled atomic.Bool
+	// consecutiveFailures counts the measurements that failed since the last successful one.
+	consecutiveFailures atomic.Int64
+	// scanFailures counts the consecutive measurements whose scan failed, and
+	// reenableAt is the number of them at which the adapter is next
+	// power-cycled, 0 until the first attempt. Only used by the measurement loop.
+	scanFailures int
+	reenableAt   int
+	// emptyCycleCount is the number of consecutive measurements that found no
+	// tag since the adapter was last power-cycled. Only used by the measurement loop.
+	emptyCycleCount int
+	// ready is set after the first successful measurement.
+	ready atomic.Bool
+
+	// scanMu serializes calls to adapter.StopScan.
+	scanMu sync.Mutex
+
+	// packetsReceived counts the packets processed in continuous mode since the last tick.
+	packetsReceived atomic.Int64
+
+	printVersion   = flag.Bool("version", false, "Print the version and exit")
+	configPath     = flag.String("config", "", "Path to a YAML file setting flags by name, flags given on the command line take precedence")
+	logLevel       = flag.String("log_level", "info", "Minimum level of the logs: debug, info, warn or error")
+	logFormat      = flag.String("log_format", "text", "Format of the logs: text or json")
+	units          = flag.String("units", "metric", "Units of the temperatures and pressures in the logs: metric or imperial. Imperial also exports ruuvi_temperature_fahrenheit and ruuvi_pressure_inhg, the other metrics are always in SI units")
+	jsonStdout     = flag.Bool("json_stdout", false, "Write every measurement to stdout as a line of JSON, logs are always written to stderr")
+	measureEvery   = flag.Duration("measure_every", 5*time.Minute, "Get measurements once every specified duration")
+	intervals      = flag.String("tag_intervals", "", "Comma-separated list of MAC=duration pairs giving tags their own measure interval instead of measure_every, e.g. CB:B8:33:4C:88:4F=1m. In continuous mode, the packets of these tags are exported at most once per interval")
+	jitter         = flag.Duration("jitter", 0, "Maximum random delay added before the first measurement and to every measure_every interval, to spread the scans of several instances")
+	addr           = flag.String("addr", "127.0.0.1:8045", "address:port to listen on")
+	metricPrefix   = flag.String("metric_prefix", "ruuvi", "Prefix of the names of the exported metrics, e.g. ruuvi_temperature. Empty for no prefix, which gives the metrics exported before it was added, like temperature, their original names")
+	metricsPath    = flag.String("metrics_path", "/metrics", "HTTP path to serve the metrics on, an index page linking to it is served on /")
+	healthAddr     = flag.String("health_addr", "", "address:port to serve /healthz and /readyz on instead of -addr, without TLS")
+	gracePeriod    = flag.Duration("shutdown_timeout", 5*time.Second, "Maximum time to wait for in-flight HTTP requests to complete when shutting down")
+	enablePprof    = flag.Bool("pprof", false, "Serve the runtime profiling data under /debug/pprof and the last packet of each address under /debug/raw, exposing internals of the process")
+	manufacturerID = flag.Uint("manufacturer_id", 1177, "Bluetooth company identifier of the manufacturer data holding the Ruuvi payload, 1177 is Ruuvi Innovations")
+	serviceUUID    = flag.Uint("service_uuid", 0, "16-bit UUID of the service data carrying the Ruuvi payload of the advertisements relayed to -gateway_listen that have no manufacturer data with -manufacturer_id, 0 to not look for it in service data")
+	tlsCert        = flag.String("tls_cert", "", "Path to a TLS certificate to serve HTTPS with, requires -tls_key")
+	tlsKey         = flag.String("tls_key", "", "Path to the private key of the TLS certificate")
+	adapterID      = flag.String("adapter", "", "ID of the bluetooth adapter to use, e.g. hci1, the default adapter is used when empty")
+	tags           = flag.String("tags", "", "Comma-separated list of MAC addresses of the tags to measure, any Ruuvi tag is measured when empty")
+	nameFilter     = flag.String("name_filter", "ruuvi", "Only measure the devices whose name contains this text, ignoring case, unless -tags is set. When empty, any device advertising data with -manufacturer_id is measured")
+	minRSSI        = flag.Int("min_rssi", 0, "Ignore the advertisements received with a lower RSSI in dBm, e.g. -80, unless they come from one of -tags, 0 to accept any")
+	scanWindow     = flag.Duration("scan_window", 10*time.Second, "How long each measurement listens for advertisements, keeping the latest packet of every tag seen")
+	scanTimeout    = flag.Duration("scan_timeout", 30*time.Second, "Maximum duration of a scan before the measurement is abandoned, must be longer than -scan_window")
+	leafTempOffset = flag.Float64("leaf_temp_offset", 0, "Difference in celsius between the leaf and air temperatures the vapor pressure deficit is computed for, e.g. -2 for leaves cooler than the air")
+	batteryLowV    = flag.Float64("battery_low_voltage", 2.5, "Battery voltage in volts under which ruuvi_battery_low reports the battery of a tag as low, lowered by 0.2V below 0°C and 0.5V below -20°C as coin cells sag in the cold")
+	tiltAngle      = flag.Float64("tilt_angle", 45, "Angle in degrees from vertical beyond which a tag is reported as tilted")
+	statsWindow    = flag.Duration("stats_window", 24*time.Hour, "Sliding window over which the minimum and maximum temperature and humidity of each tag are tracked")
+	textfileDir    = flag.String("textfile_dir", "", "Directory of the node_exporter textfile collector to write the metrics of each tag to as ruuvi_<mac>.prom after each of its measurements, disabled when empty")
+	statePath      = flag.String("state_file", "", "Path of a file the latest readings are saved to every measure_every and restored from on startup, disabled when empty")
+	timestamps     = flag.Bool("sample_timestamps", false, "Export the per-tag metrics with the time their last packet was received as timestamp instead of the scrape time. Prometheus rejects samples older than about an hour, use with -stale_after. The metrics pushed to -pushgateway_url never carry timestamps, which the Pushgateway rejects")
+	staleAfter     = flag.Duration("stale_after", 0, "Stop exporting the metrics of tags that have not been seen for this duration, 0 to keep them forever")
+	unhealthyAfter = flag.Int("unhealthy_after", 5, "Number of consecutive failed measurements after which /healthz reports the exporter as unhealthy, 0 to never")
+	replayPath     = flag.String("replay", "", "Path of a file of hex-encoded packets, one per line optionally preceded by the tag address, to process one per measure_every instead of scanning")
+	continuous     = flag.Bool("continuous", false, "Listen for advertisements continuously and update metrics as they arrive instead of scanning once every measure_every")
+	gatewayAddr    = flag.String("gateway_listen", "", "address:port to accept the advertisements relayed by Ruuvi Gateways over HTTP on instead of scanning with a local adapter, their packets are processed as they arrive like in continuous mode.")
+	listDevices    = flag.Bool("list_devices", false, "Scan for scan_window, print every device seen with its address, RSSI, name, manufacturer IDs and Ruuvi data format, and exit")
+	once           = flag.Bool("once", false, "Make a single measurement and exit, with a non-zero status if it failed, instead of serving the metrics. Use with -pushgateway_url, -json_stdout or another publisher, e.g. from cron")
+	allowDups      = flag.Bool("allow_duplicates", false, "Process the repeated advertisements of a packet with the same measurement sequence number in continuous mode, which are dropped by default. Duplicates can't be filtered by the adapter, keeping them only costs CPU and publisher traffic for no new data. Scans in periodic mode always keep the latest packet of each tag")
+	names          = flag.String("names", "", "Comma-separated list of MAC=name pairs giving friendly names to tags, e.g. CB:B8:33:4C:88:4F=garage")
+	keys           = flag.String("encryption_keys", "", "Comma-separated list of MAC=key pairs giving the hexadecimal AES-128 keys to decrypt the Data format 8 packets of tags with")
+	measureBuckets = flag.String("duration_buckets", "", "Comma-separated list of the upper bounds in seconds of the measurement_duration histogram buckets, exponential buckets from 10ms to 60s when empty")
+	scanRetries    = flag.Int("scan_retries", 2, "Number of times a failed scan is retried within a measurement, retries never run past measure_every")
+	scanRetryDelay = flag.Duration("scan_retry_delay", time.Second, "Delay before the first scan retry, doubled with jitter for each following retry")
+	enableTimeout  = flag.Duration("enable_timeout", time.Minute, "How long enabling the adapter on startup is retried for before giving up, as the Bluetooth stack may still be starting at boot, 0 to try once")
+	reenableAfter  = flag.Int("reenable_after", 3, "Number of consecutive measurements whose scan failed or timed out after which the adapter is power-cycled to reset its controller, on Linux only, twice as many failures are awaited before each following attempt, 0 to never")
+	emptyCycles    = flag.Int("empty_cycles_before_reset", 0, "Number of consecutive measurements finding no tag after which the adapter is power-cycled, on Linux only, as a controller can silently stop reporting advertisements, 0 to never")
+
+	mqttBroker      = flag.String("mqtt_broker", "", "MQTT broker URL to publish measurements to, e.g. tcp://localhost:1883, disabled when empty")
+	mqttTopicPrefix = flag.String("mqtt_topic_prefix", "ruuvi", "Prefix of the MQTT topics measurements are published to as <prefix>/<mac>/state")
+	mqttClientID    = flag.String("mqtt_client_id", defaultMQTTClientID(), "Client ID to connect to the MQTT broker with, which must be unique among its clients as a new connection with the same ID closes the previous one")
+	mqttUser        = flag.String("mqtt_user", "", "Username to authenticate to the MQTT broker with")
+	mqttPassword    = flag.String("mqtt_password", "", "Password to authenticate to the MQTT broker with")
+	haDiscovery     = flag.Bool("ha_discovery", false, "Publish Home Assistant MQTT discovery configs for the tags")
+
+	influxURL        = flag.String("influx_url", "", "URL of the InfluxDB v2 server to write measurements to, e.g. http://localhost:8086, or of the 1.x server with -influx_v1, disabled when empty")
+	influxOrg        = flag.String("influx_org", "", "InfluxDB organization to write measurements to")
+	influxBucket     = flag.String("influx_bucket", "ruuvi", "InfluxDB bucket to write measurements to")
+	influxToken      = flag.String("influx_token", "", "InfluxDB API token")
+	influxV1         = flag.Bool("influx_v1", false, "Write to the /write API of InfluxDB 1.x, with -influx_db, -influx_rp and -influx_user instead of the organization, bucket and token")
+	influxDB         = flag.String("influx_db", "ruuvi", "InfluxDB 1.x database to write measurements to")
+	influxRP         = flag.String("influx_rp", "", "InfluxDB 1.x retention policy to write measurements to, the default one of the database when empty")
+	influxUser       = flag.String("influx_user", "", "InfluxDB 1.x username, no authentication when empty")
+	influxPassword   = flag.String("influx_password", "", "InfluxDB 1.x password")
+	influxFlushEvery = flag.Duration("influx_flush_every", 10*time.Second, "How often measurements are written to InfluxDB in a batch")
+
+	pushgatewayURL      = flag.String("pushgateway_url", "", "URL of a Prometheus Pushgateway to push the metrics to after each measurement, e.g. http://localhost:9091, disabled when empty")
+	pushgatewayJob      = flag.String("pushgateway_job", "ruuvi", "Job label of the metrics pushed to the Pushgateway")
+	pushgatewayInstance = flag.String("pushgateway_instance", "", "Instance label grouping the metrics pushed to the Pushgateway, no instance grouping when empty")
+
+	csvPath    = flag.String("csv_file", "", "Path of a CSV file a row is appended to for each measurement, disabled when empty")
+	csvMaxSize = flag.Int64("csv_max_size", 10<<20, "Size in bytes beyond which the CSV file is rotated, 0 to never rotate it by size")
+	csvDaily   = flag.Bool("csv_daily", false, "Rotate the CSV file every day")
+
+	movementWebhookURL = flag.String("movement_webhook", "", "URL to POST a JSON event to when the movement counter of a tag increments, disabled when empty")
+	movementDebounce   = flag.Duration("movement_debounce", time.Minute, "Minimum time between two movement events of a tag, the last movement during this time is notified once it is over")
+
+	alertRules   = flag.String("alert_rules", "", "Comma-separated list of alert rules exported as ruuvi_alert_active, each an optional MAC address and = followed by a temperature, humidity, pressure or battery_voltage threshold and an optional clear threshold, e.g. CB:B8:33:4C:88:4F=temperature<2/3,humidity>70/65")
+	alertWebhook = flag.String("alert_webhook", "", "URL to POST a JSON event to when an alert rule fires or clears, disabled when empty")
+
+	metricsAuthToken = flag.String("metrics_auth_token", "", "Bearer token required to access /metrics, no authentication when empty")
+	metricsBasicUser = flag.String("metrics_basic_user", "", "Username required to access /metrics with basic auth, requires -metrics_basic_pass")
+	metricsBasicPass = flag.String("metrics_basic_pass", "", "Password required to access /metrics with basic auth")
+
+	// latest holds the most recent reading of each tag served on /latest.
+	latest = &latestReadings{readings: make(map[string]reading)}
+	// raw holds the last packet of each address served on /debug/raw.
+	raw = &rawPackets{packets: make(map[string]rawPacket)}
+	// publishers are the outputs that measurements are sent to.
+	publishers = []publisher{latest}
+
+	// allowedTags is the set of MAC addresses parsed from the tags flag.
+	allowedTags map[string]bool
+	// tagNames maps MAC addresses to the friendly names parsed from the names flag.
+	tagNames map[string]string
+	// tagIntervals maps MAC addresses to the measure intervals parsed from the tag_intervals flag.
+	tagIntervals map[string]time.Duration
+	// encryptionKeys maps MAC addresses to the keys parsed from the encryption_keys flag.
+	encryptionKeys map[string][]byte
 )
 
-func parsePacket(buf []byte) error {
-	fmt.Printf("data (len: %d): %v (%x)\n", len(buf), buf, buf)
+// parseNames parses a comma-separated list of MAC=name pairs.
+func parseNames(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		mac, name, ok := strings.Cut(entry, "=")
+		mac, name = strings.ToUpper(strings.TrimSpace(mac)), strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid entry %q, want MAC=name", entry)
+		}
+		if _, err := bluetooth.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("invalid MAC address in entry %q: %w", entry, err)
+		}
+		m[mac] = name
+	}
+	return m, nil
+}
+
+// parseIntervals parses a comma-separated list of MAC=duration pairs.
+func parseIntervals(s string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		mac, interval, ok := strings.Cut(entry, "=")
+		mac = strings.ToUpper(strings.TrimSpace(mac))
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, want MAC=duration", entry)
+		}
+		if _, err := bluetooth.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("invalid MAC address in entry %q: %w", entry, err)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid interval in entry %q, want a positive duration", entry)
+		}
+		m[mac] = d
+	}
+	return m, nil
+}
+
+// tagInterval returns the measure interval of the tag with the given MAC
+// address, ok is false when its packets are exported as soon as they arrive.
+func tagInterval(mac string) (interval time.Duration, ok bool) {
+	if interval, ok := tagIntervals[mac]; ok {
+		return interval, true
+	}
+	if streaming() {
+		return 0, false
+	}
+	return *measureEvery, true
+}
+
+// streaming reports whether packets are processed as they arrive rather than
+// once per measurement.
+func streaming() bool {
+	return *continuous || *gatewayAddr != ""
+}
+
+// measurePeriod returns the period of the periodic measurements, the shortest of all the measure intervals.
+func measurePeriod() time.Duration {
+	period := *measureEvery
+	for _, interval := range tagIntervals {
+		period = min(period, interval)
+	}
+	return period
+}
+
+// tagName returns the friendly name of the tag with the given MAC address, or the MAC address itself if it has none.
+func tagName(mac string) string {
+	if name, ok := tagNames[mac]; ok {
+		return name
+	}
+	return mac
+}
+
+// parseTags parses a comma-separated list of MAC addresses into a set.
+func parseTags(s string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, mac := range strings.Split(s, ",") {
+		if mac = strings.ToUpper(strings.TrimSpace(mac)); mac == "" {
+			continue
+		}
+		if _, err := bluetooth.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q: %w", mac, err)
+		}
+		set[mac] = true
+	}
+	return set, nil
+}
+
+// parseBuckets parses a comma-separated list of increasing histogram bucket
+// upper bounds, defaulting to exponential buckets from 10ms to 60s when empty.
+func parseBuckets(s string) ([]float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return prometheus.ExponentialBucketsRange(0.01, 60, 16), nil
+	}
+	var buckets []float64
+	for _, entry := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %w", entry, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be increasing, got %v after %v", b, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// errScanTimeout is returned when a scan did not complete within the scan timeout.
+var errScanTimeout = errors.New("scan timed out")
+
+// errScan is returned when the adapter failed to scan.
+var errScan = errors.New("scanning")
+
+// errNoTagFound is returned when a scan completed without receiving any packet from a tag.
+var errNoTagFound = errors.New("no Ruuvi tag found")
+
+// errParse is returned when a packet could not be parsed.
+var errParse = errors.New("parsing packet")
+
+// errThrottled is returned for a packet received before the measure interval of its tag elapsed.
+var errThrottled = errors.New("packet before the measure interval of the tag")
+
+// errDuplicate is returned in continuous mode for a packet with the same sequence number as the previous one of its tag.
+var errDuplicate = errors.New("duplicate packet")
+
+// ErrUnsupportedFormat is returned when a packet uses a data format that has no decoder.
+var ErrUnsupportedFormat = errors.New("unsupported data format")
+
+// ErrLengthMismatch is returned when a packet does not have the exact length of its data format.
+var ErrLengthMismatch = errors.New("payload length mismatch")
+
+// dataFormat describes how to decode one of the Ruuvi data formats.
+type dataFormat struct {
+	// length is the manufacturer data length of a packet in this format.
+	length int
+	decode func(buf []byte) (Measurement, error)
+	// fields are the JSON names of the Measurement fields the format carries.
+	fields []string
+}
+
+// dataFormats holds the supported data formats keyed by their first byte.
+var dataFormats = map[byte]dataFormat{
+	2: {length: 6, decode: parseEddystone, fields: []string{"temperature", "humidity", "pressure"}},
+	3: {length: 14, decode: parseFormat3, fields: []string{"temperature", "humidity", "pressure", "acceleration_x", "acceleration_y", "acceleration_z", "battery_voltage"}},
+	4: {length: 6, decode: parseEddystone, fields: []string{"temperature", "humidity", "pressure"}},
+	5: {length: 24, decode: parseFormat5, fields: []string{"temperature", "humidity", "pressure", "acceleration_x", "acceleration_y", "acceleration_z", "battery_voltage", "tx_power", "movement_counter", "measurement_sequence"}},
+	8: {length: 24, decode: parseFormat8, fields: []string{"temperature", "humidity", "pressure", "battery_voltage", "tx_power", "movement_counter", "measurement_sequence"}},
+}
+
+var (
+	tagInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tag_info",
+		Help: "Data format of the packets of the tag, which determines the metrics it has, always 1",
+	}, append(tagLabels[:len(tagLabels):len(tagLabels)], "data_format"))
+
+	tagFormatsMu sync.Mutex
+	// tagFormats holds the data format of the last packet of each tag.
+	tagFormats = make(map[string]byte)
+)
+
+// noteFormat logs the fields the tag with the given MAC address reports,
+// when first seen or after it changed data format, and sets its info metric.
+func noteFormat(mac string, format byte) {
+	tagFormatsMu.Lock()
+	defer tagFormatsMu.Unlock()
+	if last, ok := tagFormats[mac]; ok && last == format {
+		return
+	}
+	tagFormats[mac] = format
+	slog.Info("Tag uses data format", "mac", mac, "name", tagName(mac), "format", format, "fields", dataFormats[format].fields)
+	tagInfoGauge.DeletePartialMatch(prometheus.Labels{"mac": mac})
+	tagInfoGauge.WithLabelValues(mac, tagName(mac), strconv.Itoa(int(format))).Set(1)
+}
+
+// forgetFormat forgets the data format of the tag with the given MAC address.
+func forgetFormat(mac string) {
+	tagFormatsMu.Lock()
+	defer tagFormatsMu.Unlock()
+	delete(tagFormats, mac)
+	tagInfoGauge.DeletePartialMatch(prometheus.Labels{"mac": mac})
+}
+
+// Measurement is the result of parsing a Ruuvi packet.
+// Fields that the tag reported as not available are left nil.
+type Measurement struct {
+	// MAC is the address of the tag that produced the packet, as found in the payload.
+	MAC            string   `json:"mac"`
+	TemperatureC   *float64 `json:"temperature,omitempty"`
+	HumidityPct    *float64 `json:"humidity,omitempty"`
+	PressureHPa    *float64 `json:"pressure,omitempty"`
+	AccelX         *int16   `json:"acceleration_x,omitempty"` // milli-g
+	AccelY         *int16   `json:"acceleration_y,omitempty"` // milli-g
+	AccelZ         *int16   `json:"acceleration_z,omitempty"` // milli-g
+	BatteryV       *float64 `json:"battery_voltage,omitempty"`
+	TxPowerDBm     *int     `json:"tx_power,omitempty"`
+	MovementCount  *uint8   `json:"movement_counter,omitempty"`
+	SequenceNumber *uint16  `json:"measurement_sequence,omitempty"`
+	// RSSI is the signal strength in dBm the packet was received with.
+	RSSI int16 `json:"rssi"`
+}
+
+// publisher is an output that measurements are sent to in addition to the prometheus gauges.
+type publisher interface {
+	publish(m Measurement)
+	close()
+}
+
+// forgetter is implemented by the publishers keeping state per tag, which is
+// deleted when the tag is evicted.
+type forgetter interface {
+	forget(mac string)
+}
+
+// parsePacket decodes buf with the decoder of the data format found in its first byte.
+// Any input is safe to decode: the length of buf is checked against the
+// format before decoding, so the decoders can index it without checks.
+func parsePacket(buf []byte) (Measurement, error) {
+	defer func(start time.Time) {
+		parseTime.Observe(time.Since(start).Seconds())
+	}(time.Now())
+	if len(buf) == 0 {
+		return Measurement{}, errors.New("empty packet")
+	}
+	f, ok := dataFormats[buf[0]]
+	if !ok {
+		return Measurement{}, fmt.Errorf("%w: %d", ErrUnsupportedFormat, buf[0])
+	}
+	if len(buf) != f.length {
+		return Measurement{}, fmt.Errorf("%w for format %d: got %d bytes, want %d", ErrLengthMismatch, buf[0], len(buf), f.length)
+	}
+	return f.decode(buf)
+}
+
+// parseFormat3 decodes a Data format 3 (RAWv1) packet, which does not carry the mac address.
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-3-rawv1
+func parseFormat3(buf []byte) (Measurement, error) {
+	var m Measurement
+	parseWeather(buf, &m)
+
+	// Acceleration, signed values in milli-g.
+	for i, axis := range []**int16{&m.AccelX, &m.AccelY, &m.AccelZ} {
+		acceleration := int16(binary.BigEndian.Uint16(buf[6+2*i : 8+2*i]))
+		*axis = &acceleration
+	}
+
+	batteryVoltage := float64(binary.BigEndian.Uint16(buf[12:14])) / 1000 // volts
+	m.BatteryV = &batteryVoltage
+	return m, nil
+}
+
+// parseWeather decodes the humidity, temperature and pressure of buf into m,
+// which Data formats 2, 3 and 4 encode the same way in buf[1:6].
+func parseWeather(buf []byte, m *Measurement) {
+	humidity := float64(buf[1]) * 0.5 // percentage
+	m.HumidityPct = &humidity
+
+	// Temperature, the highest bit of the integer part is a sign bit, not two's complement.
+	temp := float64(buf[2]&0x7F) + float64(buf[3])/100 // degrees
+	if buf[2]&0x80 != 0 {
+		temp = -temp
+	}
+	m.TemperatureC = &temp
+
+	pressure := (float64(binary.BigEndian.Uint16(buf[4:6])) + 50000) / 100 // compensate the 50000 offset, in Pa
+	m.PressureHPa = &pressure
+}
+
+// parseFormat5 decodes a Data format 5 (RAWv2) packet.
+func parseFormat5(buf []byte) (Measurement, error) {
+	var m Measurement
 	// Notifications are like Data format 5, without the mac address because payloads are limited to 20 bytes.
 	// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-5-rawv2
 	// Format is described in:
 	// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/broadcast_formats.md
-	if buf[0] != 5 {
-		return fmt.Errorf("invalid format, packet did not start with 5")
+	parseEnvironment(buf[1:7], &m)
+
+	// Acceleration, signed values in milli-g.
+	for i, axis := range []**int16{&m.AccelX, &m.AccelY, &m.AccelZ} {
+		a := binary.BigEndian.Uint16(buf[7+2*i : 9+2*i])
+		if a == 0x8000 {
+			continue
+		}
+		acceleration := int16(a) // two's complement
+		*axis = &acceleration
 	}
-	// Temperature
-	ts := fmt.Sprintf("%x", buf[1:3])
-	t, err := strconv.ParseInt(ts, 16, 64)
-	if err != nil {
-		return fmt.Errorf("could not convert %s from hexadecimal to decimal: %w", ts, err)
+
+	parsePowerInfo(buf[13:15], &m)
+	parseCounters(buf[15:18], &m)
+
+	// MAC address, all ones when not available
+	if mac := buf[18:24]; !bytes.Equal(mac, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		m.MAC = formatMAC(mac)
+	}
+	return m, nil
+}
+
+// parseEnvironment decodes the temperature, humidity and pressure of b into
+// m, laid out as in Data formats 5 and 8.
+func parseEnvironment(b []byte, m *Measurement) {
+	// Temperature, a signed value so that sub-zero temperatures are reported correctly.
+	if t := binary.BigEndian.Uint16(b[0:2]); t != 0x8000 {
+		temp := float64(int16(t)) * 0.005 // degrees
+		m.TemperatureC = &temp
 	}
-	temp := float64(t) * 0.005 // degrees
-	fmt.Printf("Temperature: %.2f°C\n", temp)
-	tempGauge.Set(temp)
 
 	// Humidity
-	hs := fmt.Sprintf("%x", buf[3:5])
-	h, err := strconv.ParseInt(hs, 16, 64)
-	if err != nil {
-		return fmt.Errorf("could not convert %s from hexadecimal to decimal: %w", hs, err)
+	if h := binary.BigEndian.Uint16(b[2:4]); h != 0xFFFF {
+		humidity := float64(h) * 0.0025 // percentage
+		m.HumidityPct = &humidity
 	}
-	humidity := float64(h) * 0.0025 // percentage
-	fmt.Printf("Humidity: %.2f%%\n", humidity)
-	humidityGauge.Set(humidity)
 
 	// Pressure
-	ps := fmt.Sprintf("%x", buf[5:7])
-	p, err := strconv.ParseInt(ps, 16, 64)
+	if p := binary.BigEndian.Uint16(b[4:6]); p != 0xFFFF {
+		pressure := (float64(p) + 50000) / 100 // compensate the 50000 offset, in Pa
+		m.PressureHPa = &pressure
+	}
+}
+
+// parsePowerInfo decodes the power info of b into m: the first 11 bits are
+// the battery voltage above 1.6V in mV, the remaining 5 bits are the TX power
+// above -40dBm in 2dBm steps.
+func parsePowerInfo(b []byte, m *Measurement) {
+	powerInfo := binary.BigEndian.Uint16(b)
+	if powerInfo>>5 != 0x7FF {
+		batteryVoltage := float64(1600+powerInfo>>5) / 1000 // volts, summed in mV to avoid rounding errors
+		m.BatteryV = &batteryVoltage
+	}
+	if powerInfo&0x1F != 0x1F {
+		txPower := -40 + int(powerInfo&0x1F)*2 // dBm
+		m.TxPowerDBm = &txPower
+	}
+}
+
+// parseCounters decodes the movement counter and the measurement sequence
+// number of b into m.
+func parseCounters(b []byte, m *Measurement) {
+	if movementCounter := b[0]; movementCounter != 0xFF {
+		m.MovementCount = &movementCounter
+	}
+	if seq := binary.BigEndian.Uint16(b[1:3]); seq != 0xFFFF {
+		m.SequenceNumber = &seq
+	}
+}
+
+// formatMAC formats the 6 bytes of a MAC address as found in packets.
+func formatMAC(b []byte) string {
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", b[0], b[1], b[2], b[3], b[4], b[5])
+}
+
+// markSeen records that a valid packet of the tag with the given MAC address was just received.
+func markSeen(mac string) {
+	labels := []string{mac, tagName(mac)}
+	now := time.Now()
+	lastSeenMu.Lock()
+	lastSeen[mac] = now
+	lastSeenMu.Unlock()
+	lastSeenGauge.WithLabelValues(labels...).Set(float64(now.Unix()))
+	tagUpGauge.WithLabelValues(labels...).Set(1)
+}
+
+// imperial reports whether imperial units are selected by the units flag.
+func imperial() bool {
+	return *units == "imperial"
+}
+
+// logTemperature converts a temperature in celsius to the units of the logs.
+func logTemperature(tempC float64) float64 {
+	if imperial() {
+		return fahrenheit(tempC)
+	}
+	return tempC
+}
+
+// logPressure converts a pressure in hPa to the units of the logs.
+func logPressure(pressureHPa float64) float64 {
+	if imperial() {
+		return inchesOfMercury(pressureHPa)
+	}
+	return pressureHPa
+}
+
+// updateMetrics logs the measurement and publishes it to the prometheus gauges of its tag.
+// Fields that are not available leave their gauge unchanged, except for the
+// acceleration axes and the TX power which stop being exported.
+func updateMetrics(m Measurement) {
+	labels := []string{m.MAC, tagName(m.MAC)}
+	attrs := []any{"mac", m.MAC, "name", labels[1], "rssi", m.RSSI}
+	rssiGauge.WithLabelValues(labels...).Set(float64(m.RSSI))
+	markSeen(m.MAC)
+	if m.TemperatureC != nil {
+		attrs = append(attrs, "temp", logTemperature(*m.TemperatureC))
+		tempGauge.WithLabelValues(labels...).Set(*m.TemperatureC)
+		if imperial() {
+			tempFahrenheitGauge.WithLabelValues(labels...).Set(fahrenheit(*m.TemperatureC))
+		}
+		updateExtremes(labels, "temperature", *m.TemperatureC, temperatureMinGauge, temperatureMaxGauge)
+		updateTemperatureTrend(labels, *m.TemperatureC)
+	} else {
+		slog.Warn("Temperature not available", "mac", m.MAC)
+		numInvalidReadings.Inc()
+	}
+	if m.HumidityPct != nil {
+		attrs = append(attrs, "humidity", *m.HumidityPct)
+		humidityGauge.WithLabelValues(labels...).Set(*m.HumidityPct)
+		updateExtremes(labels, "humidity", *m.HumidityPct, humidityMinGauge, humidityMaxGauge)
+	} else {
+		slog.Warn("Humidity not available", "mac", m.MAC)
+		numInvalidReadings.Inc()
+	}
+	if m.PressureHPa != nil {
+		attrs = append(attrs, "pressure", logPressure(*m.PressureHPa))
+		pressureGauge.WithLabelValues(labels...).Set(*m.PressureHPa)
+		if imperial() {
+			pressureInHgGauge.WithLabelValues(labels...).Set(inchesOfMercury(*m.PressureHPa))
+		}
+	} else {
+		slog.Warn("Pressure not available", "mac", m.MAC)
+		numInvalidReadings.Inc()
+	}
+	if m.TemperatureC != nil && m.HumidityPct != nil {
+		if dewPoint := dewPointC(*m.TemperatureC, *m.HumidityPct); !math.IsNaN(dewPoint) {
+			attrs = append(attrs, "dew_point", logTemperature(dewPoint))
+			dewPointGauge.WithLabelValues(labels...).Set(dewPoint)
+		}
+		absHumidity := absoluteHumidity(*m.TemperatureC, *m.HumidityPct)
+		attrs = append(attrs, "absolute_humidity", absHumidity)
+		absoluteHumidityGauge.WithLabelValues(labels...).Set(absHumidity)
+		vpd := vaporPressureDeficitKPa(*m.TemperatureC, *m.HumidityPct, *leafTempOffset)
+		attrs = append(attrs, "vpd", vpd)
+		vpdGauge.WithLabelValues(labels...).Set(vpd)
+		heatIndex := heatIndexC(*m.TemperatureC, *m.HumidityPct)
+		attrs = append(attrs, "heat_index", logTemperature(heatIndex))
+		heatIndexGauge.WithLabelValues(labels...).Set(heatIndex)
+	}
+	for _, axis := range []struct {
+		name  string
+		value *int16
+		gauge *prometheus.GaugeVec
+	}{{"acceleration_x", m.AccelX, accelerationXGauge}, {"acceleration_y", m.AccelY, accelerationYGauge}, {"acceleration_z", m.AccelZ, accelerationZGauge}} {
+		if axis.value == nil {
+			// Not available, don't keep exporting the last value the axis had.
+			axis.gauge.DeleteLabelValues(labels...)
+			continue
+		}
+		attrs = append(attrs, axis.name, *axis.value)
+		axis.gauge.WithLabelValues(labels...).Set(float64(*axis.value))
+	}
+	if m.AccelX != nil && m.AccelY != nil && m.AccelZ != nil {
+		x, y, z := float64(*m.AccelX), float64(*m.AccelY), float64(*m.AccelZ)
+		magnitude := accelerationMagnitude(x, y, z)
+		attrs = append(attrs, "acceleration_total", magnitude)
+		accelerationTotalGauge.WithLabelValues(labels...).Set(magnitude)
+		if tilt := tiltDegrees(x, y, z); !math.IsNaN(tilt) {
+			attrs = append(attrs, "tilt", tilt)
+			tilted := 0.0
+			if tilt > *tiltAngle {
+				tilted = 1
+			}
+			tiltGauge.WithLabelValues(labels...).Set(tilted)
+		}
+		if pitch, roll, ok := pitchRollDegrees(x, y, z); ok {
+			attrs = append(attrs, "pitch", pitch, "roll", roll)
+			pitchGauge.WithLabelValues(labels...).Set(pitch)
+			rollGauge.WithLabelValues(labels...).Set(roll)
+		} else {
+			// The orientation is unknown while the tag accelerates.
+			pitchGauge.DeleteLabelValues(labels...)
+			rollGauge.DeleteLabelValues(labels...)
+		}
+	}
+	if m.BatteryV != nil {
+		attrs = append(attrs, "battery", *m.BatteryV)
+		batteryVoltageGauge.WithLabelValues(labels...).Set(*m.BatteryV)
+		percent := batteryPercent(*m.BatteryV)
+		attrs = append(attrs, "battery_percent", percent)
+		batteryPercentGauge.WithLabelValues(labels...).Set(percent)
+		threshold := *batteryLowV
+		if m.TemperatureC != nil {
+			threshold = batteryLowThreshold(threshold, *m.TemperatureC)
+		}
+		low := 0.0
+		if *m.BatteryV < threshold {
+			low = 1
+		}
+		batteryLowGauge.WithLabelValues(labels...).Set(low)
+	}
+	if m.TxPowerDBm != nil {
+		attrs = append(attrs, "tx_power", *m.TxPowerDBm)
+		txPowerGauge.WithLabelValues(labels...).Set(float64(*m.TxPowerDBm))
+	} else {
+		// Formats without TX power don't export it, tags reporting it as invalid stop exporting it.
+		txPowerGauge.DeleteLabelValues(labels...)
+	}
+	if m.MovementCount != nil {
+		attrs = append(attrs, "movement_counter", *m.MovementCount)
+		movementCounterGauge.WithLabelValues(labels...).Set(float64(*m.MovementCount))
+	}
+	if m.SequenceNumber != nil {
+		seq := int(*m.SequenceNumber)
+		attrs = append(attrs, "sequence", seq)
+		lastSeenMu.Lock()
+		last, ok := lastSequences[m.MAC]
+		lastSequences[m.MAC] = seq
+		lastSeenMu.Unlock()
+		if ok && seq == last {
+			slog.Warn("Sequence number unchanged since last measurement, packet is stale or duplicated", "mac", m.MAC, "sequence", seq)
+		}
+		measurementSequenceGauge.WithLabelValues(labels...).Set(float64(seq))
+	}
+	slog.Info("Measurement", attrs...)
+}
+
+// stopScan stops the scan in progress, if any. The adapter does not support
+// concurrent calls to StopScan so they are serialized here.
+func stopScan(s Scanner) {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	if err := s.StopScan(); err != nil {
+		slog.Warn("Stopping scan", "err", err)
+	}
+}
+
+// isTag reports whether device is one of the tags to measure: either one of
+// the allowed tags, or any device close enough whose name contains the name
+// filter, ignoring case, when none is allowed.
+func isTag(device bluetooth.ScanResult) bool {
+	if len(allowedTags) > 0 {
+		return allowedTags[device.Address.String()]
+	}
+	if *minRSSI != 0 && int(device.RSSI) < *minRSSI {
+		return false
+	}
+	return strings.Contains(strings.ToLower(device.LocalName()), strings.ToLower(*nameFilter))
+}
+
+// tagPayload returns the Ruuvi payload advertised by device, ok is false when
+// the device is not one of the tags to measure or carries no payload.
+func tagPayload(device bluetooth.ScanResult) (payload []byte, ok bool) {
+	if !isTag(device) {
+		return nil, false
+	}
+	manufacturerData := device.ManufacturerData()
+	payload, ok = findPayload(manufacturerData, device.Bytes())
+	if len(manufacturerData) > 1 {
+		slog.Debug("Tag advertised several manufacturer data records", "address", device.Address.String(), "manufacturer_ids", manufacturerIDs(manufacturerData), "found", ok)
+	}
+	if !ok {
+		// Tells a tag in range whose payload is missing from no tag in range.
+		if manufacturerData == nil {
+			slog.Debug("Tag advertised without manufacturer data", "address", device.Address.String(), "name", device.LocalName())
+		} else {
+			slog.Debug("Tag advertised without a Ruuvi payload", "address", device.Address.String(), "name", device.LocalName(), "manufacturer_ids", manufacturerIDs(manufacturerData))
+		}
+	}
+	return payload, ok
+}
+
+// manufacturerIDs returns the sorted company identifiers of manufacturer data records, for logging.
+func manufacturerIDs(manufacturerData map[uint16][]byte) []uint16 {
+	ids := make([]uint16, 0, len(manufacturerData))
+	for id := range manufacturerData {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// findPayload returns the Ruuvi payload found in the manufacturer data of an
+// advertisement or in the service data of its raw payload.
+func findPayload(manufacturerData map[uint16][]byte, raw []byte) (payload []byte, ok bool) {
+	if payload = manufacturerData[uint16(*manufacturerID)]; len(payload) > 0 {
+		return payload, true
+	}
+	services := serviceData(raw)
+	// Legacy tags broadcast Data formats 2 and 4 as Eddystone-URL frames.
+	if payload, ok = eddystonePayload(services[eddystoneUUID]); ok {
+		return payload, true
+	}
+	// Relayed advertisements may carry the payload as service data instead,
+	// only trusted with the configured UUID as any service data can start
+	// with the byte of a data format.
+	if *serviceUUID != 0 {
+		if data := services[uint16(*serviceUUID)]; len(data) > 0 {
+			if _, ok := dataFormats[data[0]]; ok {
+				return data, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// serviceData extracts the 16-bit UUID service data fields of a raw
+// advertisement payload, keyed by UUID. The scan results of the bluetooth
+// package never carry the raw payload, on any platform, so service data is
+// only found in the advertisements relayed to -gateway_listen.
+func serviceData(raw []byte) map[uint16][]byte {
+	const serviceData16 = 0x16 // AD type of service data with a 16-bit UUID
+	return adFields(raw, serviceData16)
+}
+
+// manufacturerData extracts the manufacturer specific data fields of a raw
+// advertisement payload, keyed by company identifier.
+func manufacturerData(raw []byte) map[uint16][]byte {
+	const manufacturerSpecific = 0xFF // AD type of manufacturer specific data
+	return adFields(raw, manufacturerSpecific)
+}
+
+// adFields extracts the fields of the given AD type from a raw advertisement
+// payload, keyed by the 16-bit little endian identifier they start with.
+// Advertisements may carry several fields of the same type, e.g. the
+// manufacturer data of the different beacons a device is combining.
+func adFields(raw []byte, adType byte) map[uint16][]byte {
+	data := make(map[uint16][]byte)
+	for len(raw) > 1 {
+		fieldLen := int(raw[0])
+		if fieldLen == 0 || fieldLen >= len(raw) {
+			break
+		}
+		if field := raw[1 : fieldLen+1]; field[0] == adType && len(field) >= 3 {
+			// Keep the first field with an identifier, like the platforms do.
+			if id := binary.LittleEndian.Uint16(field[1:3]); data[id] == nil {
+				data[id] = field[3:]
+			}
+		}
+		raw = raw[fieldLen+1:]
+	}
+	return data
+}
+
+// capturedPacket is the latest packet received from an address during a scan along with its signal strength.
+type capturedPacket struct {
+	rssi    int16
+	payload []byte
+}
+
+// countPacket counts a processed packet with the given result, by its data format.
+func countPacket(buf []byte, result string) {
+	format := ""
+	if len(buf) > 0 {
+		format = strconv.Itoa(int(buf[0]))
+	}
+	numPackets.WithLabelValues(format, result).Inc()
+}
+
+// processPacket parses a packet advertised by address and publishes the resulting measurement.
+func processPacket(address string, rssi int16, buf []byte) error {
+	slog.Debug("Received packet", "address", address, "len", len(buf), "data", fmt.Sprintf("%x", buf))
+	raw.record(address, buf)
+	m, err := parsePacket(buf)
+	if errors.Is(err, ErrEncrypted) {
+		// Expected for tags encrypting their packets unless the user configures their key.
+		slog.Debug("Ignoring encrypted packet", "address", address, "mac", m.MAC)
+		countPacket(buf, "encrypted")
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("could not convert %s from hexadecimal to decimal: %w", ps, err)
-	}
-	pressure := (float64(p) + 50000) / 100 // compensate the 50000 offset, in Pa
-	fmt.Printf("Pressure: %.2f hPa\n", pressure)
-	pressureGauge.Set(pressure)
-
-	// Battery voltage
-	// TODO: Fix computation, unclear in which sense the "first 11 bits" are taken...
-	// bs := fmt.Sprintf("%x", buf[13:15])
-	// fmt.Println(bs)
-	// b, err := strconv.ParseInt(bs, 16, 64)
-	// if err != nil {
-	// 	fmt.Printf("Could not convert %s from hexadecimal to decimal: %v\n", bs, err)
-	// 	return
-	// }
-	// fmt.Println(b)
-	// fmt.Println(b & 0x0EFF)
-	// batteryVoltage := 1.6 + float32(b&0x0EFF)/1000 // mV above 1.6V
-	// fmt.Printf("Battery: %.2fV\n", batteryVoltage)
+		if errors.Is(err, ErrUnsupportedFormat) {
+			numUnsupportedFormats.WithLabelValues(strconv.Itoa(int(buf[0]))).Inc()
+			countPacket(buf, "unsupported")
+		} else {
+			countPacket(buf, "invalid")
+		}
+		return fmt.Errorf("%w from %s: %w", errParse, address, err)
+	}
+	if m.MAC == "" {
+		// Not all formats carry the mac address, or it may not be available, fall
+		// back to the advertising address.
+		m.MAC = address
+	}
+	raw.parsed(address, m.MAC)
+	noteFormat(m.MAC, buf[0])
+	if h := m.HumidityPct; h != nil && (*h < 0 || *h > 100) {
+		// Corrupted packets can decode to impossible values, which derived metrics can't handle.
+		slog.Warn("Humidity out of range, clamping it to [0,100]", "mac", m.MAC, "humidity", *h)
+		clamped := math.Min(math.Max(*h, 0), 100)
+		m.HumidityPct = &clamped
+	}
+	if streaming() && !*allowDups && m.SequenceNumber != nil {
+		// The same advertisement is usually received several times in a row.
+		lastSeenMu.Lock()
+		last, ok := lastSequences[m.MAC]
+		lastSeenMu.Unlock()
+		if ok && last == int(*m.SequenceNumber) {
+			countPacket(buf, "duplicate")
+			return errDuplicate
+		}
+	}
+	if interval, ok := tagInterval(m.MAC); ok {
+		// Packets received a bit early are not skipped in periodic mode, as
+		// they may be anywhere in the scan window.
+		var tolerance time.Duration
+		if !streaming() {
+			tolerance = *scanWindow
+		}
+		lastSeenMu.Lock()
+		last, ok := lastExported[m.MAC]
+		lastSeenMu.Unlock()
+		if ok && time.Since(last) < interval-tolerance {
+			markSeen(m.MAC)
+			countPacket(buf, "throttled")
+			return errThrottled
+		}
+	}
+	lastSeenMu.Lock()
+	lastExported[m.MAC] = time.Now()
+	lastSeenMu.Unlock()
+	countPacket(buf, "ok")
+	m.RSSI = rssi
+	updateMetrics(m)
+	for _, p := range publishers {
+		p.publish(m)
+	}
 	return nil
 }
 
-func measure() error {
+// measure scans with s and processes the latest packet of every tag seen,
+// only ever parsing packets that were captured: errNoTagFound is returned when
+// no tag was seen, and the errors of the packets when none could be processed. The scan is stopped when ctx is done, ctx.Err() is returned then.
+func measure(ctx context.Context, s Scanner) error {
 	start := time.Now()
 	defer func() {
 		measureTime.Observe(time.Since(start).Seconds())
 	}()
+	defer countTagsSeen(start)
 
-	// var ruuvi bluetooth.ScanResult
-	var stopScanErr error
-	buf := make([]byte, 32)
+	packets, err := scan(ctx, s)
+	for attempt := 0; err != nil && ctx.Err() == nil && !errors.Is(err, errScanTimeout) && attempt < *scanRetries; attempt++ {
+		delay := retryDelay(attempt)
+		// A retry must be done before the next measurement is due.
+		if time.Since(start)+delay+*scanWindow >= measurePeriod() {
+			break
+		}
+		slog.Warn("Scan failed, retrying", "err", err, "attempt", attempt+1, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		packets, err = scan(ctx, s)
+	}
+	if err != nil {
+		return err
+	}
+	defer markMissingTags(start)
 
-	if err := adapter.Scan(func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
-		println("found device:", device.Address.String(), device.RSSI, device.LocalName(), device.ManufacturerData(), device.AdvertisementPayload)
-		if !strings.Contains(device.LocalName(), "Ruuvi") {
-			return
+	if len(packets) == 0 {
+		return errNoTagFound
+	}
+	var errs []error
+	for address, p := range packets {
+		if err := processPacket(address, p.rssi, p.payload); err != nil && !errors.Is(err, errThrottled) {
+			// Counted in packets_total, the packet of one tag failing to
+			// parse must not fail the measurement of the others.
+			slog.Warn("Ignoring packet", "address", address, "err", err)
+			errs = append(errs, err)
 		}
+	}
+	if len(errs) < len(packets) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
 
-		md := device.ManufacturerData()
-		buffer, ok := md[1177]
-		if !ok {
-			return
+// markMissingTags reports the tags seen before that have not been seen since the given time as down.
+func markMissingTags(since time.Time) {
+	lastSeenMu.Lock()
+	defer lastSeenMu.Unlock()
+	for mac, t := range lastSeen {
+		if t.Before(since) {
+			tagUpGauge.WithLabelValues(mac, tagName(mac)).Set(0)
 		}
-		copy(buf, buffer)
+	}
+}
 
-		fmt.Println("Stopping scan")
-		if err := adapter.StopScan(); err != nil {
-			stopScanErr = fmt.Errorf("stopping scan: %w", err)
+// countTagsSeen reports the number of tags seen since the given time.
+func countTagsSeen(since time.Time) {
+	lastSeenMu.Lock()
+	defer lastSeenMu.Unlock()
+	seen := 0
+	for _, t := range lastSeen {
+		if !t.Before(since) {
+			seen++
 		}
-	}); err != nil {
-		return fmt.Errorf("scanning: %w", err)
 	}
-	if stopScanErr != nil {
-		return stopScanErr
+	tagsSeenGauge.Set(float64(seen))
+}
+
+// randDuration returns a random duration in [0, max), 0 when max is not positive.
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// retryDelay returns the delay before the given scan retry, starting at 0:
+// the retry delay doubled for each previous retry plus up to 50% of jitter.
+func retryDelay(attempt int) time.Duration {
+	delay := *scanRetryDelay << attempt
+	if delay <= 0 {
+		return 0
 	}
-	fmt.Println("Stopped scan")
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// scan listens for advertisements during the scan window and returns the
+// latest packet per advertising address seen.
+func scan(ctx context.Context, s Scanner) (map[string]capturedPacket, error) {
+	defer func(start time.Time) {
+		scanTime.Observe(time.Since(start).Seconds())
+	}(time.Now())
+	packets := make(map[string]capturedPacket)
 
-	if err := parsePacket(buf); err != nil {
-		return fmt.Errorf("parsing packet: %w", err)
+	stopTimer := time.AfterFunc(*scanWindow, func() {
+		slog.Debug("Stopping scan")
+		stopScan(s)
+	})
+	defer stopTimer.Stop()
+	stopOnDone := context.AfterFunc(ctx, func() { stopScan(s) })
+	defer stopOnDone()
+
+	// The scan normally stops at the end of the window, the timeout guards
+	// against the adapter never returning from Scan.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Scan(func(device bluetooth.ScanResult) {
+			slog.Debug("Found device", "address", device.Address.String(), "rssi", device.RSSI, "name", device.LocalName(), "manufacturer_data", device.ManufacturerData())
+			buffer, ok := tagPayload(device)
+			if !ok {
+				return
+			}
+			packets[device.Address.String()] = capturedPacket{rssi: device.RSSI, payload: append([]byte(nil), buffer...)}
+		})
+	}()
+	select {
+	case err := <-done:
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errScan, err)
+		}
+	case <-time.After(*scanTimeout):
+		stopScan(s)
+		return nil, fmt.Errorf("%w after %v", errScanTimeout, *scanTimeout)
+	}
+	slog.Debug("Stopped scan")
+	return packets, nil
+}
+
+// recordMeasurement updates the measurement counters and the health state with the outcome of a measurement.
+func recordMeasurement(err error) {
+	if err != nil {
+		numMeasurementsErrs.Inc()
+		numMeasurementErrsByReason.WithLabelValues(errorReason(err)).Inc()
+		consecutiveFailures.Add(1)
+		return
+	}
+	numMeasurements.Inc()
+	lastSuccessGauge.SetToCurrentTime()
+	consecutiveFailures.Store(0)
+	ready.Store(true)
+}
+
+// errorReasons are the reasons a measurement can fail for, from the most to the least specific.
+var errorReasons = []struct {
+	reason string
+	err    error
+}{
+	{"timeout", errScanTimeout},
+	{"scan_error", errScan},
+	{"not_found", errNoTagFound},
+	{"length_mismatch", ErrLengthMismatch},
+	{"parse_error", errParse},
+}
+
+// errorReason returns the reason label of a failed measurement.
+func errorReason(err error) string {
+	for _, r := range errorReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return "other"
+}
+
+// reenableAdapter power-cycles the adapter once the scans of reenable_after
+// measurements in a row failed, err being the outcome of the last one, to
+// recover from a stuck controller. Measurements failing for other reasons,
+// e.g. finding no tag, are left to resetAfterEmptyCycles. Further attempts
+// back off exponentially while the scans keep failing.
+func reenableAdapter(err error) {
+	if !errors.Is(err, errScan) && !errors.Is(err, errScanTimeout) {
+		scanFailures, reenableAt = 0, 0
+		return
+	}
+	scanFailures++
+	if !canPowerCycle || *reenableAfter <= 0 || scanFailures < *reenableAfter || scanFailures < reenableAt {
+		return
+	}
+	reenableAt = 2 * scanFailures
+	slog.Warn("Power-cycling the adapter", "consecutive_scan_failures", scanFailures)
+	if err := resetAdapter(); err != nil {
+		slog.Error("Power-cycling the adapter", "err", err, "next_attempt_after_scan_failures", reenableAt)
+	}
+}
+
+// resetAdapter power-cycles the adapter, counting the attempt and recording
+// whether the adapter is enabled after it.
+func resetAdapter() error {
+	numAdapterReenables.Inc()
+	err := powerCycleAdapter()
+	adapterEnabled.Store(err == nil)
+	return err
+}
+
+// resetAfterEmptyCycles power-cycles the adapter once empty_cycles_before_reset
+// measurements in a row found no tag, err being the outcome of the last one.
+func resetAfterEmptyCycles(err error) {
+	if !errors.Is(err, errNoTagFound) {
+		emptyCycleCount = 0
+		return
+	}
+	emptyCycleCount++
+	if !canPowerCycle || *emptyCycles <= 0 || emptyCycleCount < *emptyCycles {
+		return
+	}
+	emptyCycleCount = 0
+	slog.Warn("No tag found in the last measurements, power-cycling the adapter", "empty_cycles", *emptyCycles)
+	if err := resetAdapter(); err != nil {
+		slog.Error("Power-cycling the adapter", "err", err)
+	}
+}
+
+// enableWithRetries enables the adapter of s, retrying with an increasing
+// delay until it succeeds or the next attempt would be after timeout.
+func enableWithRetries(s Scanner, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.Enable()
+		if err == nil || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		slog.Warn("Enabling adapter failed, retrying", "err", err, "attempt", attempt, "delay", delay)
+		time.Sleep(delay)
+		delay = min(2*delay, 30*time.Second)
+	}
+}
+
+// listen scans continuously and publishes measurements as soon as packets arrive.
+// It only returns when the scan fails or ctx is done.
+func listen(ctx context.Context, s Scanner) error {
+	stopOnDone := context.AfterFunc(ctx, func() { stopScan(s) })
+	defer stopOnDone()
+	if err := s.Scan(func(device bluetooth.ScanResult) {
+		buffer, ok := tagPayload(device)
+		if !ok {
+			return
+		}
+		address := device.Address.String()
+		err := processPacket(address, device.RSSI, buffer)
+		if errors.Is(err, errDuplicate) || errors.Is(err, errThrottled) {
+			return
+		}
+		if err != nil {
+			slog.Warn("Measurement failed", "address", address, "err", err)
+		} else {
+			packetsReceived.Add(1)
+		}
+		recordMeasurement(err)
+	}); err != nil {
+		return fmt.Errorf("%w: %w", errScan, err)
 	}
 	return nil
 }
 
+// newLogger returns a logger writing to stderr with the given level (debug,
+// info, warn or error) and format (text or json).
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+}
+
+// fatal logs msg and its attributes as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
 	flag.Parse()
-	// Enable BLE interface.
-	if err := adapter.Enable(); err != nil {
-		log.Fatal(err)
+	if *printVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *configPath != "" {
+		if err := loadConfig(*configPath); err != nil {
+			fatal("Loading config file", "err", err)
+		}
+	}
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Configuring logging", "err", err)
+	}
+	slog.SetDefault(logger)
+	if *units != "metric" && *units != "imperial" {
+		fatal("-units must be metric or imperial", "units", *units)
+	}
+	if *scanWindow <= 0 {
+		fatal("-scan_window must be positive", "scan_window", *scanWindow)
+	}
+	if *scanTimeout <= *scanWindow {
+		fatal("-scan_timeout must be longer than -scan_window", "scan_window", *scanWindow)
+	}
+	if *manufacturerID > 0xFFFF {
+		fatal("-manufacturer_id must fit in 16 bits", "manufacturer_id", *manufacturerID)
+	}
+	if *serviceUUID > 0xFFFF {
+		fatal("-service_uuid must fit in 16 bits", "service_uuid", *serviceUUID)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls_cert and -tls_key must be set together")
+	}
+	if (*metricsBasicUser == "") != (*metricsBasicPass == "") {
+		fatal("-metrics_basic_user and -metrics_basic_pass must be set together")
+	}
+	if *metricPrefix != "" && !metricPrefixRE.MatchString(*metricPrefix) {
+		fatal("-metric_prefix must only contain letters, digits and underscores, and not start with a digit", "metric_prefix", *metricPrefix)
+	}
+	if !strings.HasPrefix(*metricsPath, "/") || *metricsPath == "/" {
+		fatal("-metrics_path must be an absolute path other than /", "metrics_path", *metricsPath)
+	}
+	if *statsWindow <= 0 {
+		fatal("-stats_window must be positive", "stats_window", *statsWindow)
+	}
+	if *replayPath != "" && *continuous {
+		fatal("-replay cannot be used with -continuous")
+	}
+	if *gatewayAddr != "" && (*continuous || *replayPath != "") {
+		fatal("-gateway_listen cannot be used with -continuous or -replay")
+	}
+	if *listDevices && (*replayPath != "" || *gatewayAddr != "") {
+		fatal("-list_devices cannot be used with -replay or -gateway_listen")
+	}
+	if *once && streaming() {
+		fatal("-once cannot be used with -continuous or -gateway_listen")
+	}
+	if *reenableAfter < 0 {
+		fatal("-reenable_after must not be negative", "reenable_after", *reenableAfter)
+	}
+	if *enableTimeout < 0 {
+		fatal("-enable_timeout must not be negative", "enable_timeout", *enableTimeout)
+	}
+	if *emptyCycles < 0 {
+		fatal("-empty_cycles_before_reset must not be negative", "empty_cycles_before_reset", *emptyCycles)
+	}
+	if *scanRetries < 0 {
+		fatal("-scan_retries must not be negative", "scan_retries", *scanRetries)
+	}
+	if allowedTags, err = parseTags(*tags); err != nil {
+		fatal("Parsing -tags", "err", err)
+	}
+	if tagNames, err = parseNames(*names); err != nil {
+		fatal("Parsing -names", "err", err)
+	}
+	if tagIntervals, err = parseIntervals(*intervals); err != nil {
+		fatal("Parsing -tag_intervals", "err", err)
+	}
+	if encryptionKeys, err = parseKeys(*keys); err != nil {
+		fatal("Parsing -encryption_keys", "err", err)
+	}
+	rules, err := parseAlertRules(*alertRules)
+	if err != nil {
+		fatal("Parsing -alert_rules", "err", err)
+	}
+	if *alertWebhook != "" && len(rules) == 0 {
+		fatal("-alert_webhook requires -alert_rules")
+	}
+	measureOnce := func(ctx context.Context) error { return measure(ctx, scanner) }
+	if *replayPath != "" {
+		r, err := loadReplay(*replayPath)
+		if err != nil {
+			fatal("Loading packets to replay", "err", err)
+		}
+		slog.Info("Replaying packets instead of scanning", "path", *replayPath, "packets", len(r.packets))
+		measureOnce = r.measure
+	} else if *gatewayAddr == "" {
+		if *adapterID != "" {
+			if err := selectAdapter(*adapterID); err != nil {
+				fatal("Selecting adapter", "adapter", *adapterID, "err", err)
+			}
+		}
+		// Enable BLE interface.
+		if err := enableWithRetries(scanner, *enableTimeout); err != nil {
+			fatal("Enabling adapter", "err", err)
+		}
+	}
+	adapterEnabled.Store(true)
+	if *listDevices {
+		if err := printDevices(scanner, os.Stdout, *scanWindow); err != nil {
+			fatal("Listing devices", "err", err)
+		}
+		return
 	}
 
+	buckets, err := parseBuckets(*measureBuckets)
+	if err != nil {
+		fatal("Parsing -duration_buckets", "err", err)
+	}
+	measureTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "measurement_duration",
+		Help:    "Seconds it took to make a measurement",
+		Buckets: buckets,
+	})
+	scanTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "scan_duration_seconds",
+		Help:    "Seconds spent scanning for advertisements, retries are observed separately",
+		Buckets: buckets,
+	})
+
 	// Register prometheus metrics
-	prometheus.MustRegister(numMeasurements, numMeasurementsErrs, tempGauge, humidityGauge, pressureGauge, measureTime)
+	buildInfoGauge.WithLabelValues(version, buildCommit(), runtime.Version()).Set(1)
+	measureIntervalGauge.Set(measurePeriod().Seconds())
+	scanWindowGauge.Set(scanWindow.Seconds())
+	// Every metric is registered with the prefix as namespace.
+	registerer := prometheus.Registerer(registry)
+	if *metricPrefix != "" {
+		registerer = prometheus.WrapRegistererWithPrefix(*metricPrefix+"_", registerer)
+	}
+	registerer.MustRegister(buildInfoGauge, numMeasurements, numMeasurementsErrs, numMeasurementErrsByReason, numAdapterReenables, lastSuccessGauge, measureIntervalGauge, scanWindowGauge, tagsSeenGauge, tagInfoGauge, alertActiveGauge, numUnsupportedFormats, numPackets, numInvalidReadings, measureTime, scanTime, parseTime)
+	if *timestamps {
+		// tag_up is left out as its 0 samples would carry the timestamp of the last 1.
+		var timestamped []*prometheus.GaugeVec
+		for _, g := range tagGauges {
+			if g != tagUpGauge {
+				timestamped = append(timestamped, g)
+			}
+		}
+		registerer.MustRegister(timestampedCollector{gauges: timestamped}, tagUpGauge)
+	} else {
+		for _, g := range tagGauges {
+			registerer.MustRegister(g)
+		}
+	}
+	// Export every reason from the start so that increases from 0 show up.
+	for _, r := range errorReasons {
+		numMeasurementErrsByReason.WithLabelValues(r.reason)
+	}
 
 	// Register HTTP Server and handlers for prometheus metrics.
-	http.Handle("/metrics", promhttp.Handler())
-	go http.ListenAndServe(*addr, nil)
+	// A dedicated mux so that the pprof handlers are only served when enabled.
+	mux := http.NewServeMux()
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	mux.Handle("/", indexHandler(*metricsPath))
+	// The probes are served on their own listener when health_addr is set.
+	healthMux := mux
+	if *healthAddr != "" {
+		healthMux = http.NewServeMux()
+	}
+	healthMux.HandleFunc("/healthz", healthzHandler)
+	healthMux.HandleFunc("/readyz", readyzHandler)
+	mux.Handle("/latest", latest)
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/raw", raw)
+	}
+	// Registered last so that a path already served is reported rather than
+	// making the mux panic.
+	if _, pattern := mux.Handler(&http.Request{URL: &url.URL{Path: *metricsPath}}); pattern == *metricsPath {
+		fatal("-metrics_path must not be a path already served by the exporter", "metrics_path", *metricsPath)
+	}
+	mux.Handle(*metricsPath, requireAuth(metricsHandler))
+	// Stop cleanly on SIGINT and SIGTERM or when the HTTP server fails,
+	// interrupting any scan in progress so that the adapter is not left scanning.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancelCause(sigCtx)
+	defer cancel(nil)
+	go func() {
+		<-ctx.Done()
+		// The scan in progress, if any, is stopped by its own context.
+		slog.Info("Shutting down")
+	}()
 
-	// Do an initial measurement.
-	if err := measure(); err != nil {
-		log.Fatal(err)
+	serve := func(srv *http.Server, useTLS bool) {
+		var err error
+		if useTLS {
+			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			cancel(fmt.Errorf("HTTP server on %s: %w", srv.Addr, err))
+		}
 	}
-	// Then continue measuring periodically.
-	ticker := time.NewTicker(*measureEvery)
-	fmt.Println("Starting measurements ticker")
-	for range ticker.C {
-		if err := measure(); err != nil {
-			fmt.Println(err)
+	var servers []*http.Server
+	// A single measurement is not served, its metrics are pushed by the publishers.
+	if !*once {
+		servers = append(servers, &http.Server{Addr: *addr, Handler: mux})
+		go serve(servers[0], *tlsCert != "")
+		if *healthAddr != "" {
+			// Probes are made by the orchestrator, without TLS.
+			servers = append(servers, &http.Server{Addr: *healthAddr, Handler: healthMux})
+			go serve(servers[len(servers)-1], false)
 		}
 	}
+	if *gatewayAddr != "" {
+		servers = append(servers, &http.Server{Addr: *gatewayAddr, Handler: &gatewayHandler{}})
+		go serve(servers[len(servers)-1], false)
+	}
+
+	if *mqttBroker != "" {
+		// Tags named or allowed by flags are known upfront, others are discovered when first seen.
+		var knownTags []string
+		for mac := range allowedTags {
+			knownTags = append(knownTags, mac)
+		}
+		for mac := range tagNames {
+			if !allowedTags[mac] {
+				knownTags = append(knownTags, mac)
+			}
+		}
+		publishers = append(publishers, newMQTTPublisher(*mqttBroker, *mqttClientID, *mqttTopicPrefix, *mqttUser, *mqttPassword, *haDiscovery, knownTags))
+	}
+
+	if *influxURL != "" {
+		var w *influxWriter
+		var err error
+		if *influxV1 {
+			w, err = newInfluxV1Writer(*influxURL, *influxDB, *influxRP, *influxUser, *influxPassword, *influxFlushEvery)
+		} else {
+			w, err = newInfluxWriter(*influxURL, *influxOrg, *influxBucket, *influxToken, *influxFlushEvery)
+		}
+		if err != nil {
+			fatal("Configuring InfluxDB", "err", err)
+		}
+		publishers = append(publishers, w)
+	}
+
+	if *csvPath != "" {
+		w, err := newCSVWriter(*csvPath, *csvMaxSize, *csvDaily)
+		if err != nil {
+			fatal("Opening CSV file", "err", err)
+		}
+		publishers = append(publishers, w)
+	}
+
+	if *movementWebhookURL != "" {
+		publishers = append(publishers, newMovementWebhook(*movementWebhookURL, *movementDebounce))
+	}
+
+	if len(rules) > 0 {
+		publishers = append(publishers, newAlerter(rules, *alertWebhook))
+	}
+
+	if *statePath != "" {
+		if err := restoreState(*statePath); err != nil {
+			slog.Warn("Restoring state, starting without the latest readings", "err", err)
+		}
+		publishers = append(publishers, newStateFile(*statePath, *measureEvery))
+	}
+
+	if *pushgatewayURL != "" {
+		pusher = newPusher(*pushgatewayURL, *pushgatewayJob, *pushgatewayInstance)
+	}
+
+	if *textfileDir != "" {
+		publishers = append(publishers, newTextfileWriter(*textfileDir, registry))
+	}
+
+	if *jsonStdout {
+		publishers = append(publishers, newJSONLinesPublisher(os.Stdout))
+	}
+
+	if *staleAfter > 0 {
+		go evictStaleTags(ctx, *staleAfter)
+	}
+
+	if streaming() {
+		if *gatewayAddr != "" {
+			slog.Info("Accepting packets from Ruuvi Gateways", "addr", *gatewayAddr)
+		} else {
+			go func() {
+				if err := listen(ctx, scanner); err != nil {
+					fatal("Listening", "err", err)
+				}
+			}()
+			slog.Info("Listening continuously")
+		}
+		// Gauges are updated as packets arrive, the ticker only reports on activity.
+		ticker := time.NewTicker(*measureEvery)
+		periodStart := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				shutdown(ctx, servers)
+				return
+			case tick := <-ticker.C:
+				countTagsSeen(periodStart)
+				periodStart = tick
+				if n := packetsReceived.Swap(0); n == 0 {
+					slog.Warn("No packet received", "period", *measureEvery)
+				} else {
+					slog.Info("Received packets", "count", n, "period", *measureEvery)
+				}
+				pushMetrics()
+			}
+		}
+	}
+
+	// Spread the scans of instances started together so that their radios don't collide.
+	if *jitter > 0 {
+		select {
+		case <-ctx.Done():
+			shutdown(ctx, servers)
+			return
+		case <-time.After(randDuration(*jitter)):
+		}
+	}
+	if *once {
+		err := measureOnce(ctx)
+		if err != nil {
+			slog.Error("Measurement failed", "err", err)
+		}
+		recordMeasurement(err)
+		pushMetrics()
+		for _, p := range publishers {
+			p.close()
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	// Do an initial measurement, failing is not fatal as the tag may not be advertising yet.
+	// Measurements interrupted by the shutdown are not recorded.
+	if err := measureOnce(ctx); ctx.Err() == nil {
+		if err != nil {
+			slog.Warn("Initial measurement failed", "err", err)
+		}
+		recordMeasurement(err)
+		pushMetrics()
+	}
+	// Then continue measuring periodically, each measurement starting a period,
+	// plus jitter, after the previous one started whatever its duration.
+	period := measurePeriod()
+	timer := time.NewTimer(period + randDuration(*jitter))
+	slog.Info("Starting measurements ticker", "period", period, "jitter", *jitter)
+	for {
+		select {
+		case <-ctx.Done():
+			shutdown(ctx, servers)
+			return
+		case tick := <-timer.C:
+			timer.Reset(period + randDuration(*jitter) - time.Since(tick))
+			err := measureOnce(ctx)
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				slog.Warn("Measurement failed", "err", err)
+			}
+			recordMeasurement(err)
+			if *replayPath == "" {
+				reenableAdapter(err)
+				resetAfterEmptyCycles(err)
+			}
+			pushMetrics()
+		}
+	}
+}
+
+// evictStaleTags periodically deletes the series of tags that have not been seen for staleAfter, until ctx is done.
+func evictStaleTags(ctx context.Context, staleAfter time.Duration) {
+	ticker := time.NewTicker(staleAfter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lastSeenMu.Lock()
+		for mac, t := range lastSeen {
+			if time.Since(t) < staleAfter {
+				continue
+			}
+			slog.Info("Tag not seen recently, removing its metrics", "mac", mac, "last_seen", t)
+			for _, g := range tagGauges {
+				g.DeleteLabelValues(mac, tagName(mac))
+			}
+			alertActiveGauge.DeletePartialMatch(prometheus.Labels{"mac": mac})
+			delete(lastSeen, mac)
+			delete(lastExported, mac)
+			delete(lastSequences, mac)
+			raw.forget(mac)
+			for _, p := range publishers {
+				if f, ok := p.(forgetter); ok {
+					f.forget(mac)
+				}
+			}
+			forgetStats(mac)
+			forgetFormat(mac)
+		}
+		lastSeenMu.Unlock()
+	}
+}
+
+// shutdown gracefully stops the HTTP servers and the publishers once ctx is
+// done, exiting with an error if it was not cancelled by a signal.
+func shutdown(ctx context.Context, servers []*http.Server) {
+	// Let in-flight requests complete, e.g. a scrape of the last measurement.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *gracePeriod)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Shutting down HTTP server", "addr", srv.Addr, "err", err)
+		}
+	}
+	// Only closed once the gateway requests in flight, which publish, are done.
+	for _, p := range publishers {
+		p.close()
+	}
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		fatal("Stopped after a failure", "err", err)
+	}
 }
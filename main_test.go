@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Reference packets of the Ruuvi documentation, and a Data format 8 one
+// encrypting the same readings as format5Valid with testKey.
+const (
+	format3Valid = "03291A1ECE1EFC18F94202CA0B53"
+	format5Valid = "0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F"
+	format8Valid = "087D645F54DE0E24082C4F56A21C7BEC82C1CBB8334C884F"
+	testKey      = "00112233445566778899AABBCCDDEEFF"
+	testMAC      = "CB:B8:33:4C:88:4F"
+)
+
+func decodeHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+// useTestKey makes the Data format 8 packets of testMAC decryptable for the duration of the test.
+func useTestKey(t testing.TB) {
+	t.Helper()
+	keys, err := parseKeys(testMAC + "=" + testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := encryptionKeys
+	encryptionKeys = keys
+	t.Cleanup(func() { encryptionKeys = previous })
+}
+
+// checkRanges reports the fields of m outside of the range the data formats can encode.
+func checkRanges(t *testing.T, m Measurement) {
+	t.Helper()
+	inRange := func(name string, v *float64, lo, hi float64) {
+		if v != nil && (*v < lo || *v > hi) {
+			t.Errorf("%s = %v, want in [%v, %v]", name, *v, lo, hi)
+		}
+	}
+	inRange("temperature", m.TemperatureC, -163.835, 163.835)
+	inRange("humidity", m.HumidityPct, 0, 163.835)
+	inRange("pressure", m.PressureHPa, 500, 1155.35)
+	inRange("battery voltage", m.BatteryV, 0, 65.535)
+	if m.TxPowerDBm != nil && (*m.TxPowerDBm < -40 || *m.TxPowerDBm > 20) {
+		t.Errorf("tx power = %d, want in [-40, 20]", *m.TxPowerDBm)
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	useTestKey(f)
+	for _, s := range []string{format3Valid, format5Valid, format8Valid} {
+		packet := decodeHex(f, s)
+		f.Add(packet)
+		f.Add(packet[:len(packet)-1])
+		f.Add(packet[:1])
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		m, err := parsePacket(buf)
+		if err != nil {
+			return
+		}
+		if format, ok := dataFormats[buf[0]]; !ok || len(buf) != format.length {
+			t.Errorf("parsePacket(%x) succeeded for a packet of an invalid length", buf)
+		}
+		checkRanges(t, m)
+	})
+}
+
+// Ensure the sentinel errors of malformed packets can be told apart.
+func TestParsePacketErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		packet string
+		want   error
+	}{
+		{"unsupported format", "0600", ErrUnsupportedFormat},
+		{"truncated format 5", format5Valid[:len(format5Valid)-2], ErrLengthMismatch},
+		{"truncated format 3", format3Valid[:len(format3Valid)-2], ErrLengthMismatch},
+		{"format 8 without key", format8Valid, ErrEncrypted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parsePacket(decodeHex(t, tc.packet)); !errors.Is(err, tc.want) {
+				t.Errorf("parsePacket() error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestParsePacket(t *testing.T) {
+	useTestKey(t)
+	for _, tc := range []struct {
+		name   string
+		packet string
+		want   Measurement
+	}{
+		{
+			name:   "format 5 reference",
+			packet: format5Valid,
+			want: Measurement{
+				MAC:            testMAC,
+				TemperatureC:   ptr(24.3),
+				HumidityPct:    ptr(53.49),
+				PressureHPa:    ptr(1000.44),
+				AccelX:         ptr[int16](4),
+				AccelY:         ptr[int16](-4),
+				AccelZ:         ptr[int16](1036),
+				BatteryV:       ptr(2.977),
+				TxPowerDBm:     ptr(4),
+				MovementCount:  ptr[uint8](66),
+				SequenceNumber: ptr[uint16](205),
+			},
+		},
+		{
+			name:   "format 8 reference",
+			packet: format8Valid,
+			want: Measurement{
+				MAC:            testMAC,
+				TemperatureC:   ptr(24.3),
+				HumidityPct:    ptr(53.49),
+				PressureHPa:    ptr(1000.44),
+				BatteryV:       ptr(2.977),
+				TxPowerDBm:     ptr(4),
+				MovementCount:  ptr[uint8](66),
+				SequenceNumber: ptr[uint16](205),
+			},
+		},
+		{
+			// The reference packet with the temperature of a freezer.
+			name:   "format 5 sub-zero temperature",
+			packet: "05F18C5394C37C0004FFFC040CAC364200CDCBB8334C884F",
+			want: Measurement{
+				MAC:            testMAC,
+				TemperatureC:   ptr(-18.5),
+				HumidityPct:    ptr(53.49),
+				PressureHPa:    ptr(1000.44),
+				AccelX:         ptr[int16](4),
+				AccelY:         ptr[int16](-4),
+				AccelZ:         ptr[int16](1036),
+				BatteryV:       ptr(2.977),
+				TxPowerDBm:     ptr(4),
+				MovementCount:  ptr[uint8](66),
+				SequenceNumber: ptr[uint16](205),
+			},
+		},
+		{
+			name:   "format 5 minimum values",
+			packet: "058001000000008001800180010000000000CBB8334C884F",
+			want: Measurement{
+				MAC:            testMAC,
+				TemperatureC:   ptr(-163.835),
+				HumidityPct:    ptr(0.0),
+				PressureHPa:    ptr(500.0),
+				AccelX:         ptr[int16](-32767),
+				AccelY:         ptr[int16](-32767),
+				AccelZ:         ptr[int16](-32767),
+				BatteryV:       ptr(1.6),
+				TxPowerDBm:     ptr(-40),
+				MovementCount:  ptr[uint8](0),
+				SequenceNumber: ptr[uint16](0),
+			},
+		},
+		{
+			// A tag lying upside down, with its x axis not available.
+			name:   "format 5 negative acceleration",
+			packet: "0512FC5394C37C80000000FC18AC364200CDCBB8334C884F",
+			want: Measurement{
+				MAC:            testMAC,
+				TemperatureC:   ptr(24.3),
+				HumidityPct:    ptr(53.49),
+				PressureHPa:    ptr(1000.44),
+				AccelY:         ptr[int16](0),
+				AccelZ:         ptr[int16](-1000),
+				BatteryV:       ptr(2.977),
+				TxPowerDBm:     ptr(4),
+				MovementCount:  ptr[uint8](66),
+				SequenceNumber: ptr[uint16](205),
+			},
+		},
+		{
+			// Every field not available, the MAC address included.
+			name:   "format 5 invalid values",
+			packet: "058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF",
+			want:   Measurement{},
+		},
+		{
+			name:   "format 3 reference",
+			packet: format3Valid,
+			want: Measurement{
+				TemperatureC: ptr(26.3),
+				HumidityPct:  ptr(20.5),
+				PressureHPa:  ptr(1027.66),
+				AccelX:       ptr[int16](-1000),
+				AccelY:       ptr[int16](-1726),
+				AccelZ:       ptr[int16](714),
+				BatteryV:     ptr(2.899),
+			},
+		},
+		{
+			// The sensor data of an Eddystone-URL frame, decoded like Data format 3.
+			name:   "format 4 reference",
+			packet: "04291A1ECE1E",
+			want: Measurement{
+				TemperatureC: ptr(26.3),
+				HumidityPct:  ptr(20.5),
+				PressureHPa:  ptr(1027.66),
+			},
+		},
+		{
+			// The highest bit of the temperature is a sign bit, not two's complement.
+			name:   "format 3 sub-zero temperature",
+			packet: "0300FF6300008001800180010000",
+			want: Measurement{
+				TemperatureC: ptr(-127.99),
+				HumidityPct:  ptr(0.0),
+				PressureHPa:  ptr(500.0),
+				AccelX:       ptr[int16](-32767),
+				AccelY:       ptr[int16](-32767),
+				AccelZ:       ptr[int16](-32767),
+				BatteryV:     ptr(0.0),
+			},
+		},
+		{
+			name:   "format 3 maximum values",
+			packet: "03FF7F63FFFF7FFF7FFF7FFFFFFF",
+			want: Measurement{
+				TemperatureC: ptr(127.99),
+				HumidityPct:  ptr(127.5),
+				PressureHPa:  ptr(1155.35),
+				AccelX:       ptr[int16](32767),
+				AccelY:       ptr[int16](32767),
+				AccelZ:       ptr[int16](32767),
+				BatteryV:     ptr(65.535),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parsePacket(decodeHex(t, tc.packet))
+			if err != nil {
+				t.Fatalf("parsePacket() error = %v", err)
+			}
+			checkMeasurement(t, got, tc.want)
+		})
+	}
+}
+
+// checkMeasurement reports the fields of got that differ from want, floats
+// being compared with a small tolerance.
+func checkMeasurement(t *testing.T, got, want Measurement) {
+	t.Helper()
+	if got.MAC != want.MAC {
+		t.Errorf("MAC = %q, want %q", got.MAC, want.MAC)
+	}
+	for _, f := range []struct {
+		name      string
+		got, want *float64
+	}{
+		{"temperature", got.TemperatureC, want.TemperatureC},
+		{"humidity", got.HumidityPct, want.HumidityPct},
+		{"pressure", got.PressureHPa, want.PressureHPa},
+		{"battery voltage", got.BatteryV, want.BatteryV},
+	} {
+		switch {
+		case f.got == nil && f.want == nil:
+		case f.got == nil || f.want == nil:
+			t.Errorf("%s = %v, want %v", f.name, deref(f.got), deref(f.want))
+		case math.Abs(*f.got-*f.want) > 1e-9:
+			t.Errorf("%s = %v, want %v", f.name, *f.got, *f.want)
+		}
+	}
+	checkField(t, "acceleration x", got.AccelX, want.AccelX)
+	checkField(t, "acceleration y", got.AccelY, want.AccelY)
+	checkField(t, "acceleration z", got.AccelZ, want.AccelZ)
+	checkField(t, "tx power", got.TxPowerDBm, want.TxPowerDBm)
+	checkField(t, "movement counter", got.MovementCount, want.MovementCount)
+	checkField(t, "measurement sequence", got.SequenceNumber, want.SequenceNumber)
+}
+
+func checkField[T comparable](t *testing.T, name string, got, want *T) {
+	t.Helper()
+	if (got == nil) != (want == nil) || got != nil && *got != *want {
+		t.Errorf("%s = %v, want %v", name, deref(got), deref(want))
+	}
+}
+
+// deref returns the value v points to, or nil, for error messages.
+func deref[T any](v *T) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func BenchmarkParsePacket(b *testing.B) {
+	packet := decodeHex(b, format5Valid)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parsePacket(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Ensure the transmit power and the signal strength are both exported in
+// dBm, the RSSI being how much of the transmit power is received.
+func TestProcessPacketSignal(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		packet      string
+		rssi        int16
+		wantTxPower float64
+	}{
+		{"positive tx power", format5Valid, -70, 4},
+		{"minimum tx power", "058001000000008001800180010000000000CBB8334C884F", -95, -40},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestScans(t)
+			if err := processPacket(testMAC, tc.rssi, decodeHex(t, tc.packet)); err != nil {
+				t.Fatalf("processPacket() error = %v", err)
+			}
+			if got := testutil.ToFloat64(txPowerGauge.WithLabelValues(testMAC, tagName(testMAC))); got != tc.wantTxPower {
+				t.Errorf("tx power = %v dBm, want %v", got, tc.wantTxPower)
+			}
+			if got := testutil.ToFloat64(rssiGauge.WithLabelValues(testMAC, tagName(testMAC))); got != float64(tc.rssi) {
+				t.Errorf("rssi = %v dBm, want %v", got, tc.rssi)
+			}
+		})
+	}
+}
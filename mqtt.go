@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// haSensor describes a Home Assistant sensor created for each tag by MQTT discovery.
+type haSensor struct {
+	// field is the key of the value in the JSON state payload.
+	field       string
+	name        string
+	deviceClass string
+	unit        string
+}
+
+var haSensors = []haSensor{
+	{field: "temperature", name: "Temperature", deviceClass: "temperature", unit: "°C"},
+	{field: "humidity", name: "Humidity", deviceClass: "humidity", unit: "%"},
+	{field: "pressure", name: "Pressure", deviceClass: "pressure", unit: "hPa"},
+	{field: "battery_voltage", name: "Battery voltage", deviceClass: "voltage", unit: "V"},
+	{field: "battery_percent", name: "Battery", deviceClass: "battery", unit: "%"},
+}
+
+// mqttState is the JSON state payload of a tag: its measurement along with
+// the derived values that Home Assistant sensors are created for.
+type mqttState struct {
+	Measurement
+	BatteryPercent *float64 `json:"battery_percent,omitempty"`
+}
+
+// mqttPublisher publishes measurements as JSON to an MQTT broker.
+type mqttPublisher struct {
+	client      mqtt.Client
+	topicPrefix string
+	// discovery enables publishing Home Assistant discovery configs for known tags.
+	discovery bool
+
+	mu sync.Mutex
+	// known holds the MAC addresses of the tags discovery configs were published for.
+	known map[string]bool
+}
+
+// defaultMQTTClientID returns ruuvi-<hostname>, so that the exporters of
+// different hosts publishing to the same broker don't disconnect each other.
+func defaultMQTTClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "ruuvi"
+	}
+	return "ruuvi-" + hostname
+}
+
+// newMQTTPublisher starts connecting to broker in the background, the
+// connection is retried until it succeeds and re-established when lost.
+// When discovery is set, Home Assistant discovery configs are published for
+// knownTags and for every new tag seen, and again after each reconnection.
+func newMQTTPublisher(broker, clientID, topicPrefix, username, password string, discovery bool, knownTags []string) *mqttPublisher {
+	p := &mqttPublisher{
+		topicPrefix: topicPrefix,
+		discovery:   discovery,
+		known:       make(map[string]bool),
+	}
+	for _, mac := range knownTags {
+		p.known[mac] = true
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Lost connection to MQTT broker", "broker", broker, "err", err)
+		}).
+		SetOnConnectHandler(func(mqtt.Client) {
+			slog.Info("Connected to MQTT broker", "broker", broker)
+			if !p.discovery {
+				return
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			for mac := range p.known {
+				p.publishDiscovery(mac)
+			}
+		})
+	p.client = mqtt.NewClient(opts)
+	p.client.Connect()
+	return p
+}
+
+// stateTopic returns the topic the measurements of the tag with the given MAC address are published to.
+func (p *mqttPublisher) stateTopic(mac string) string {
+	return fmt.Sprintf("%s/%s/state", p.topicPrefix, mac)
+}
+
+// publish sends m to <prefix>/<mac>/state without waiting for the broker,
+// failures are only logged so that they never hold up measurements.
+func (p *mqttPublisher) publish(m Measurement) {
+	if p.discovery {
+		p.mu.Lock()
+		if !p.known[m.MAC] {
+			p.known[m.MAC] = true
+			p.publishDiscovery(m.MAC)
+		}
+		p.mu.Unlock()
+	}
+	state := mqttState{Measurement: m}
+	if m.BatteryV != nil {
+		percent := batteryPercent(*m.BatteryV)
+		state.BatteryPercent = &percent
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		slog.Error("Encoding measurement for MQTT", "err", err)
+		return
+	}
+	p.send(p.stateTopic(m.MAC), false, payload)
+}
+
+// publishDiscovery publishes the retained Home Assistant discovery config of each sensor of a tag.
+func (p *mqttPublisher) publishDiscovery(mac string) {
+	id := strings.ToLower(strings.ReplaceAll(mac, ":", ""))
+	for _, s := range haSensors {
+		payload, err := json.Marshal(map[string]any{
+			"name":                s.name,
+			"unique_id":           fmt.Sprintf("ruuvi_%s_%s", id, s.field),
+			"state_topic":         p.stateTopic(mac),
+			"value_template":      fmt.Sprintf("{{ value_json.%s }}", s.field),
+			"device_class":        s.deviceClass,
+			"unit_of_measurement": s.unit,
+			"state_class":         "measurement",
+			"device": map[string]any{
+				"identifiers":  []string{"ruuvi_" + id},
+				"name":         tagName(mac),
+				"manufacturer": "Ruuvi Innovations",
+			},
+		})
+		if err != nil {
+			slog.Error("Encoding Home Assistant discovery config", "err", err)
+			return
+		}
+		p.send(fmt.Sprintf("homeassistant/sensor/%s_%s/config", id, s.field), true, payload)
+	}
+}
+
+// send publishes payload to topic in the background, logging failures.
+func (p *mqttPublisher) send(topic string, retained bool, payload []byte) {
+	token := p.client.Publish(topic, 0, retained, payload)
+	go func() {
+		if !token.WaitTimeout(10 * time.Second) {
+			slog.Warn("Publishing to MQTT timed out", "topic", topic)
+		} else if err := token.Error(); err != nil {
+			slog.Warn("Publishing to MQTT", "topic", topic, "err", err)
+		}
+	}()
+}
+
+// close disconnects from the broker, leaving some time for in-flight messages.
+func (p *mqttPublisher) close() {
+	p.client.Disconnect(250)
+}
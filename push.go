@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pusher pushes the metrics to a Pushgateway after each measurement cycle
+// when -pushgateway_url is set, nil otherwise.
+var pusher *push.Pusher
+
+// newPusher returns a pusher of the metrics of registry, without the Go and
+// process metrics of the exporter itself, grouped by job and, when set, instance.
+func newPusher(url, job, instance string) *push.Pusher {
+	p := push.New(url, job).
+		Gatherer(withoutTimestamps(registry)).
+		Client(&http.Client{Timeout: 10 * time.Second})
+	if instance != "" {
+		p = p.Grouping("instance", instance)
+	}
+	return p
+}
+
+// pushMetrics replaces the metrics of the group on the Pushgateway, a failed
+// push is only logged as the next cycle pushes the metrics again.
+func pushMetrics() {
+	if pusher == nil {
+		return
+	}
+	if err := pusher.Push(); err != nil {
+		slog.Warn("Pushing metrics to the Pushgateway, will retry next cycle", "err", err)
+	}
+}
+
+// withoutTimestamps returns a gatherer of the metrics of g without their
+// timestamps, as the Pushgateway rejects the samples of -sample_timestamps.
+func withoutTimestamps(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		for _, mf := range mfs {
+			for _, metric := range mf.GetMetric() {
+				metric.TimestampMs = nil
+			}
+		}
+		return mfs, err
+	})
+}
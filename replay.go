@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayAddress is the advertising address of replayed packets that don't specify one.
+const replayAddress = "00:00:00:00:00:00"
+
+// replayPacket is a captured packet to replay.
+type replayPacket struct {
+	address string
+	payload []byte
+}
+
+// replayer replays captured packets instead of scanning, one per measurement.
+type replayer struct {
+	packets []replayPacket
+	next    int
+}
+
+// loadReplay reads the packets to replay from path. Each line holds a
+// hex-encoded payload, optionally preceded by the advertising address and a
+// space. Empty lines and lines starting with # are ignored.
+func loadReplay(path string) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &replayer{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p := replayPacket{address: replayAddress}
+		if address, data, ok := strings.Cut(text, " "); ok {
+			p.address, text = strings.ToUpper(address), strings.TrimSpace(data)
+		}
+		if p.payload, err = hex.DecodeString(text); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		r.packets = append(r.packets, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(r.packets) == 0 {
+		return nil, errors.New("no packet to replay in " + path)
+	}
+	return r, nil
+}
+
+// measure processes the next packet, starting over after the last one.
+func (r *replayer) measure(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer countTagsSeen(time.Now())
+	p := r.packets[r.next]
+	r.next = (r.next + 1) % len(r.packets)
+	// Like the scans, the packets of tags not due yet are not failures.
+	if err := processPacket(p.address, 0, p.payload); err != nil && !errors.Is(err, errThrottled) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "tinygo.org/x/bluetooth"
+
+// Scanner is a BLE adapter scanning for advertisements.
+type Scanner interface {
+	// Enable makes the adapter ready to scan.
+	Enable() error
+	// Scan calls callback for every advertisement received until StopScan is called.
+	Scan(callback func(device bluetooth.ScanResult)) error
+	// StopScan stops the scan in progress, making Scan return.
+	StopScan() error
+}
+
+// adapterScanner is the Scanner of a tinygo bluetooth adapter.
+type adapterScanner struct {
+	adapter *bluetooth.Adapter
+}
+
+func (s adapterScanner) Enable() error {
+	return s.adapter.Enable()
+}
+
+func (s adapterScanner) Scan(callback func(device bluetooth.ScanResult)) error {
+	return s.adapter.Scan(func(_ *bluetooth.Adapter, device bluetooth.ScanResult) {
+		callback(device)
+	})
+}
+
+func (s adapterScanner) StopScan() error {
+	return s.adapter.StopScan()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"tinygo.org/x/bluetooth"
+)
+
+// fakeScanner is a Scanner replaying fixed advertisements, then blocking until
+// StopScan is called like an adapter does.
+type fakeScanner struct {
+	results []bluetooth.ScanResult
+	// replayed is closed once the advertisements have been replayed.
+	replayed chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newFakeScanner(results ...bluetooth.ScanResult) *fakeScanner {
+	return &fakeScanner{results: results, replayed: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+func (s *fakeScanner) Enable() error { return nil }
+
+func (s *fakeScanner) Scan(callback func(device bluetooth.ScanResult)) error {
+	for _, r := range s.results {
+		callback(r)
+	}
+	close(s.replayed)
+	<-s.stopped
+	return nil
+}
+
+func (s *fakeScanner) StopScan() error {
+	s.stopOnce.Do(func() { close(s.stopped) })
+	return nil
+}
+
+// fakePayload is the advertisement payload of a device as exposed on Linux,
+// without the raw bytes.
+type fakePayload struct {
+	name             string
+	manufacturerData map[uint16][]byte
+}
+
+func (p fakePayload) LocalName() string                   { return p.name }
+func (p fakePayload) HasServiceUUID(bluetooth.UUID) bool  { return false }
+func (p fakePayload) Bytes() []byte                       { return nil }
+func (p fakePayload) ManufacturerData() map[uint16][]byte { return p.manufacturerData }
+
+// advertisement returns the scan result of a device advertising the
+// hex-encoded packet as Ruuvi manufacturer data.
+func advertisement(t *testing.T, address, name string, rssi int16, packet string) bluetooth.ScanResult {
+	t.Helper()
+	mac, err := bluetooth.ParseMAC(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bluetooth.ScanResult{
+		Address: bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}},
+		RSSI:    rssi,
+		AdvertisementPayload: fakePayload{
+			name:             name,
+			manufacturerData: map[uint16][]byte{uint16(*manufacturerID): decodeHex(t, packet)},
+		},
+	}
+}
+
+// useTestScans shortens the scans and resets the state of the tags seen for
+// the duration of the test.
+func useTestScans(t *testing.T) {
+	t.Helper()
+	previousWindow, previousMeasureTime, previousScanTime := *scanWindow, measureTime, scanTime
+	*scanWindow = 10 * time.Millisecond
+	measureTime = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "measurement_duration_seconds"})
+	scanTime = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "scan_duration_seconds"})
+	lastExported = make(map[string]time.Time)
+	lastSequences = make(map[string]int)
+	latest.mu.Lock()
+	latest.readings = make(map[string]reading)
+	latest.mu.Unlock()
+	t.Cleanup(func() {
+		*scanWindow, measureTime, scanTime = previousWindow, previousMeasureTime, previousScanTime
+	})
+}
+
+// latestReading returns the latest reading of the tag with the given MAC address.
+func latestReading(mac string) (reading, bool) {
+	latest.mu.Lock()
+	defer latest.mu.Unlock()
+	r, ok := latest.readings[mac]
+	return r, ok
+}
+
+func TestMeasure(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		devices []bluetooth.ScanResult
+		wantErr error
+	}{
+		{"tag found", []bluetooth.ScanResult{advertisement(t, testMAC, "Ruuvi 884F", -60, format5Valid)}, nil},
+		{"tag found next to an unsupported one", []bluetooth.ScanResult{
+			advertisement(t, testMAC, "Ruuvi 884F", -60, format5Valid),
+			advertisement(t, "CB:B8:33:4C:88:50", "Ruuvi 8850", -60, "0600"),
+		}, nil},
+		{"unsupported tag only", []bluetooth.ScanResult{advertisement(t, "CB:B8:33:4C:88:50", "Ruuvi 8850", -60, "0600")}, errParse},
+		{"no device in range", nil, errNoTagFound},
+		// Packets of the devices that are not tags are never captured, so never parsed.
+		{"no tag in range", []bluetooth.ScanResult{advertisement(t, testMAC, "Other", -60, format5Valid)}, errNoTagFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestScans(t)
+			if err := measure(context.Background(), newFakeScanner(tc.devices...)); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("measure() error = %v, want %v", err, tc.wantErr)
+			}
+			r, ok := latestReading(testMAC)
+			if found := tc.wantErr == nil; ok != found {
+				t.Fatalf("reading of %s exported = %v, want %v", testMAC, ok, found)
+			}
+			if ok && (r.Measurement.TemperatureC == nil || *r.Measurement.TemperatureC != 24.3) {
+				t.Errorf("temperature = %v, want 24.3", deref(r.Measurement.TemperatureC))
+			}
+		})
+	}
+}
+
+func TestListenStopsWhenCanceled(t *testing.T) {
+	useTestScans(t)
+	s := newFakeScanner(advertisement(t, testMAC, "Ruuvi 884F", -60, format5Valid))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- listen(ctx, s) }()
+	<-s.replayed
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("listen() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listen() did not return after its context was canceled")
+	}
+	if _, ok := latestReading(testMAC); !ok {
+		t.Errorf("no reading of %s exported", testMAC)
+	}
+}
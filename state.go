@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stateFile periodically saves the latest readings to a file so that they can
+// be restored after a restart. It is a publisher so that the readings are
+// saved one last time when shutting down.
+type stateFile struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newStateFile returns a state file saving the latest readings to path every saveEvery.
+func newStateFile(path string, saveEvery time.Duration) *stateFile {
+	s := &stateFile{
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run(saveEvery)
+	return s
+}
+
+// publish does nothing, the readings are saved from latest.
+func (s *stateFile) publish(Measurement) {}
+
+func (s *stateFile) run(saveEvery time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(saveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.save()
+			return
+		case <-ticker.C:
+			s.save()
+		}
+	}
+}
+
+// save atomically replaces the state file with the latest readings, so that
+// it is never left half written on power loss.
+func (s *stateFile) save() {
+	latest.mu.Lock()
+	data, err := json.Marshal(latest.readings)
+	latest.mu.Unlock()
+	if err != nil {
+		slog.Error("Encoding state", "err", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		slog.Warn("Saving state", "path", s.path, "err", err)
+	}
+}
+
+// close saves the latest readings and stops saving them.
+func (s *stateFile) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// writeFileAtomic writes data to a temporary file next to path, then renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restoreState loads the readings saved in path and exports them as the
+// latest readings, with the time they were received as their last seen
+// timestamp. The tags are not marked as seen until they are measured again. A missing file is not an error as there is nothing to restore yet.
+func restoreState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var readings map[string]reading
+	if err := json.Unmarshal(data, &readings); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if readings == nil {
+		return nil
+	}
+	for mac, r := range readings {
+		labels := []string{mac, tagName(mac)}
+		restoreGauges(labels, r.Measurement)
+		lastSeenMu.Lock()
+		lastSeen[mac] = r.Time
+		lastSeenMu.Unlock()
+		lastSeenGauge.WithLabelValues(labels...).Set(float64(r.Time.Unix()))
+		// The tag has not been seen since the restart.
+		tagUpGauge.WithLabelValues(labels...).Set(0)
+	}
+	latest.mu.Lock()
+	latest.readings = readings
+	latest.mu.Unlock()
+	slog.Info("Restored latest readings", "path", path, "tags", len(readings))
+	return nil
+}
+
+// restoreGauges sets the gauges of the values measured in m, leaving the
+// derived metrics, statistics and sequence numbers to the next measurements.
+func restoreGauges(labels []string, m Measurement) {
+	setGauge(tempGauge, labels, m.TemperatureC)
+	setGauge(humidityGauge, labels, m.HumidityPct)
+	setGauge(pressureGauge, labels, m.PressureHPa)
+	setGauge(accelerationXGauge, labels, m.AccelX)
+	setGauge(accelerationYGauge, labels, m.AccelY)
+	setGauge(accelerationZGauge, labels, m.AccelZ)
+	setGauge(batteryVoltageGauge, labels, m.BatteryV)
+	setGauge(txPowerGauge, labels, m.TxPowerDBm)
+	setGauge(movementCounterGauge, labels, m.MovementCount)
+	setGauge(measurementSequenceGauge, labels, m.SequenceNumber)
+	rssiGauge.WithLabelValues(labels...).Set(float64(m.RSSI))
+}
+
+// setGauge sets the series of g with the given labels to the value v points to, if any.
+func setGauge[T float64 | int | int16 | uint8 | uint16](g *prometheus.GaugeVec, labels []string, v *T) {
+	if v != nil {
+		g.WithLabelValues(labels...).Set(float64(*v))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sample is a value observed at a given time.
+type sample struct {
+	t time.Time
+	v float64
+}
+
+// extremes tracks the minimum and maximum values observed over a sliding window.
+type extremes struct {
+	// min and max are monotonic queues of the samples that are, or may become
+	// once older samples leave the window, the minimum and maximum. Their first
+	// sample is the current extreme.
+	min, max []sample
+}
+
+// observe adds v observed at t and returns the extremes of the samples observed during the window ending at t.
+func (e *extremes) observe(t time.Time, v float64, window time.Duration) (lo, hi float64) {
+	s := sample{t: t, v: v}
+	e.min = pushMonotonic(e.min, s, func(last sample) bool { return last.v >= v })
+	e.max = pushMonotonic(e.max, s, func(last sample) bool { return last.v <= v })
+	cutoff := t.Add(-window)
+	e.min = expire(e.min, cutoff)
+	e.max = expire(e.max, cutoff)
+	return e.min[0].v, e.max[0].v
+}
+
+// pushMonotonic appends s to q after dropping the samples at its end that s supersedes.
+func pushMonotonic(q []sample, s sample, superseded func(last sample) bool) []sample {
+	for len(q) > 0 && superseded(q[len(q)-1]) {
+		q = q[:len(q)-1]
+	}
+	return append(q, s)
+}
+
+// expire drops the samples of q observed before cutoff, keeping at least the latest one.
+func expire(q []sample, cutoff time.Time) []sample {
+	for len(q) > 1 && q[0].t.Before(cutoff) {
+		q = q[1:]
+	}
+	return q
+}
+
+// extremesKey identifies the extremes of a quantity measured by a tag.
+type extremesKey struct {
+	mac, quantity string
+}
+
+var (
+	// tagExtremes holds the extremes of the temperature and humidity of each tag, guarded by tagExtremesMu.
+	tagExtremes   = make(map[extremesKey]*extremes)
+	tagExtremesMu sync.Mutex
+)
+
+// updateExtremes observes v for the quantity of the tag with the given
+// labels, and sets its gauges to the extremes over -stats_window.
+func updateExtremes(labels []string, quantity string, v float64, minGauge, maxGauge *prometheus.GaugeVec) {
+	key := extremesKey{mac: labels[0], quantity: quantity}
+	tagExtremesMu.Lock()
+	e, ok := tagExtremes[key]
+	if !ok {
+		e = &extremes{}
+		tagExtremes[key] = e
+	}
+	lo, hi := e.observe(time.Now(), v, *statsWindow)
+	tagExtremesMu.Unlock()
+	minGauge.WithLabelValues(labels...).Set(lo)
+	maxGauge.WithLabelValues(labels...).Set(hi)
+}
+
+const (
+	// trendSamples is the number of recent samples the temperature trend is fitted on.
+	trendSamples = 10
+	// trendSpacing is the minimum time between the samples the trend is fitted
+	// on, so that the resolution of the sensor doesn't show as spikes when
+	// packets are received every second.
+	trendSpacing = time.Minute
+)
+
+// trend estimates the rate of change of a value from its recent samples.
+type trend struct {
+	// samples is a ring buffer of the latest samples, next being the index of the oldest once it is full.
+	samples []sample
+	next    int
+}
+
+// observe adds v observed at t and returns its rate of change per hour,
+// ok is false until there are at least 2 samples to fit. The samples are
+// discarded after a gap longer than maxGap so that readings from before a
+// tag was offline don't produce a spurious spike.
+func (tr *trend) observe(t time.Time, v float64, maxGap time.Duration) (perHour float64, ok bool) {
+	if n := len(tr.samples); n > 0 {
+		last := tr.samples[(tr.next+n-1)%n]
+		if t.Sub(last.t) > maxGap {
+			tr.samples, tr.next = nil, 0
+		} else if t.Sub(last.t) < trendSpacing {
+			return tr.slope()
+		}
+	}
+	if len(tr.samples) < trendSamples {
+		tr.samples = append(tr.samples, sample{t: t, v: v})
+	} else {
+		tr.samples[tr.next] = sample{t: t, v: v}
+		tr.next = (tr.next + 1) % trendSamples
+	}
+	return tr.slope()
+}
+
+// slope returns the least squares slope of the samples in units per hour.
+func (tr *trend) slope() (perHour float64, ok bool) {
+	n := float64(len(tr.samples))
+	if n < 2 {
+		return 0, false
+	}
+	origin := tr.samples[0].t
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range tr.samples {
+		x := s.t.Sub(origin).Hours()
+		sumX += x
+		sumY += s.v
+		sumXY += x * s.v
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+var (
+	// temperatureTrends holds the temperature trend of each tag, guarded by temperatureTrendsMu.
+	temperatureTrends   = make(map[string]*trend)
+	temperatureTrendsMu sync.Mutex
+)
+
+// updateTemperatureTrend observes the temperature of the tag with the given
+// labels and sets its trend gauge once there are enough samples.
+func updateTemperatureTrend(labels []string, tempC float64) {
+	// Measurements are expected every measure_every, or continuously.
+	maxGap := 3 * *measureEvery
+	if maxGap < 3*trendSpacing {
+		maxGap = 3 * trendSpacing
+	}
+	temperatureTrendsMu.Lock()
+	tr, ok := temperatureTrends[labels[0]]
+	if !ok {
+		tr = &trend{}
+		temperatureTrends[labels[0]] = tr
+	}
+	perHour, ok := tr.observe(time.Now(), tempC, maxGap)
+	temperatureTrendsMu.Unlock()
+	if !ok {
+		// Don't keep reporting the trend from before a gap.
+		temperatureTrendGauge.DeleteLabelValues(labels...)
+		return
+	}
+	temperatureTrendGauge.WithLabelValues(labels...).Set(perHour)
+}
+
+// forgetStats drops the extremes and trend of the tag with the given MAC address.
+func forgetStats(mac string) {
+	tagExtremesMu.Lock()
+	for key := range tagExtremes {
+		if key.mac == mac {
+			delete(tagExtremes, key)
+		}
+	}
+	tagExtremesMu.Unlock()
+	temperatureTrendsMu.Lock()
+	delete(temperatureTrends, mac)
+	temperatureTrendsMu.Unlock()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// jsonLinesPublisher writes each measurement as a line of JSON, e.g. to pipe them to another program.
+type jsonLinesPublisher struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONLinesPublisher(w io.Writer) *jsonLinesPublisher {
+	return &jsonLinesPublisher{enc: json.NewEncoder(w)}
+}
+
+// publish writes m followed by a newline in a single write so that lines are never interleaved.
+func (p *jsonLinesPublisher) publish(m Measurement) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enc.Encode(m); err != nil {
+		slog.Error("Writing measurement as JSON", "err", err)
+	}
+}
+
+func (p *jsonLinesPublisher) close() {}
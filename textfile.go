@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// textfileWriter writes the metrics of each tag to a .prom file in the
+// directory of the node_exporter textfile collector after each measurement.
+type textfileWriter struct {
+	dir      string
+	gatherer prometheus.Gatherer
+}
+
+func newTextfileWriter(dir string, gatherer prometheus.Gatherer) *textfileWriter {
+	return &textfileWriter{dir: dir, gatherer: gatherer}
+}
+
+// path returns the path of the file of the tag with the given MAC address.
+func (w *textfileWriter) path(mac string) string {
+	return filepath.Join(w.dir, "ruuvi_"+strings.ToLower(strings.ReplaceAll(mac, ":", ""))+".prom")
+}
+
+// publish writes the metrics of the tag of m, which the gauges were just updated
+// with. The file is replaced atomically so that node_exporter never reads a
+// partial one.
+func (w *textfileWriter) publish(m Measurement) {
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return tagFamilies(w.gatherer, m.MAC)
+	})
+	if err := prometheus.WriteToTextfile(w.path(m.MAC), g); err != nil {
+		slog.Warn("Writing textfile collector file", "mac", m.MAC, "err", err)
+	}
+}
+
+func (w *textfileWriter) close() {}
+
+// forget removes the file of the tag with the given MAC address, so that
+// node_exporter stops exporting its metrics too.
+func (w *textfileWriter) forget(mac string) {
+	if err := os.Remove(w.path(mac)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Removing textfile collector file", "mac", mac, "err", err)
+	}
+}
+
+// tagFamilies returns the metric families gathered by g restricted to the
+// series of the tag with the given MAC address, without timestamps as the
+// textfile collector rejects them.
+func tagFamilies(g prometheus.Gatherer, mac string) ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var tagMFs []*dto.MetricFamily
+	for _, mf := range mfs {
+		var metrics []*dto.Metric
+		for _, metric := range mf.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "mac" && l.GetValue() == mac {
+					metric.TimestampMs = nil
+					metrics = append(metrics, metric)
+					break
+				}
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			tagMFs = append(tagMFs, mf)
+		}
+	}
+	return tagMFs, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// timestampedCollector collects per-tag gauges with the time the last packet
+// of their tag was received as explicit sample timestamp, rather than the
+// scrape time.
+type timestampedCollector struct {
+	gauges []*prometheus.GaugeVec
+}
+
+func (c timestampedCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, g := range c.gauges {
+		g.Describe(ch)
+	}
+}
+
+func (c timestampedCollector) Collect(ch chan<- prometheus.Metric) {
+	lastSeenMu.Lock()
+	seen := make(map[string]time.Time, len(lastSeen))
+	for mac, t := range lastSeen {
+		seen[mac] = t
+	}
+	lastSeenMu.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		for _, g := range c.gauges {
+			g.Collect(metrics)
+		}
+		close(metrics)
+	}()
+	for m := range metrics {
+		if t, ok := seen[macLabel(m)]; ok {
+			m = prometheus.NewMetricWithTimestamp(t, m)
+		}
+		ch <- m
+	}
+}
+
+// macLabel returns the value of the mac label of m, or "" if it has none.
+func macLabel(m prometheus.Metric) string {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return ""
+	}
+	for _, l := range pb.GetLabel() {
+		if l.GetName() == "mac" {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
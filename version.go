@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// version and commit are set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc123", the commit
+// defaults to the VCS revision recorded by the go command.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+var buildInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "build_info",
+	Help: "Always 1, labeled by the version, commit and Go version the exporter was built with",
+}, []string{"version", "commit", "go_version"})
+
+// buildCommit returns the commit the binary was built from, or "unknown".
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// versionString describes the build for the -version flag.
+func versionString() string {
+	return fmt.Sprintf("ruuvi %s (commit %s, %s)", version, buildCommit(), runtime.Version())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookAttempts is the number of times the delivery of a webhook event is attempted.
+const webhookAttempts = 3
+
+// movementEvent is the JSON body posted to the movement webhook.
+type movementEvent struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+	// MovementCount is the movement counter of the tag after it moved.
+	MovementCount uint8       `json:"movement_counter"`
+	Time          time.Time   `json:"time"`
+	Measurement   Measurement `json:"measurement"`
+}
+
+// movementWebhook posts an event to a URL when the movement counter of a tag
+// increments, at most once per debounce period for each tag. The last movement
+// during a debounce period is notified when the period ends.
+type movementWebhook struct {
+	url      string
+	debounce time.Duration
+	client   *http.Client
+
+	mu sync.Mutex
+	// counters holds the last movement counter of each tag.
+	counters map[string]uint8
+	// notified holds the time each tag was last notified.
+	notified map[string]time.Time
+	// suppressed holds the event of the last movement of each tag during its
+	// debounce period, notified by the timer in trailing when the period ends.
+	suppressed map[string]movementEvent
+	trailing   map[string]*time.Timer
+	// pending tracks the deliveries in progress and scheduled so that close can wait for them.
+	pending sync.WaitGroup
+}
+
+func newMovementWebhook(url string, debounce time.Duration) *movementWebhook {
+	return &movementWebhook{
+		url:        url,
+		debounce:   debounce,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		counters:   make(map[string]uint8),
+		notified:   make(map[string]time.Time),
+		suppressed: make(map[string]movementEvent),
+		trailing:   make(map[string]*time.Timer),
+	}
+}
+
+// publish delivers a movement event in the background if the movement counter
+// of the tag changed, or once its debounce period ends if it was notified
+// during the period.
+func (w *movementWebhook) publish(m Measurement) {
+	if m.MovementCount == nil {
+		return
+	}
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last, seen := w.counters[m.MAC]
+	w.counters[m.MAC] = *m.MovementCount
+	// The counter wraps around, any change is a movement.
+	if !seen || last == *m.MovementCount {
+		return
+	}
+	e := movementEvent{MAC: m.MAC, Name: tagName(m.MAC), MovementCount: *m.MovementCount, Time: now, Measurement: m}
+	if wait := w.debounce - now.Sub(w.notified[m.MAC]); wait > 0 {
+		w.suppressed[m.MAC] = e
+		if w.trailing[m.MAC] == nil {
+			w.pending.Add(1)
+			w.trailing[m.MAC] = time.AfterFunc(wait, func() { w.notifyTrailing(m.MAC) })
+		}
+		return
+	}
+	w.notify(e)
+}
+
+// notifyTrailing notifies the last movement of the tag with the given MAC
+// address during its debounce period, unless close already did.
+func (w *movementWebhook) notifyTrailing(mac string) {
+	defer w.pending.Done()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.trailing[mac] == nil {
+		return
+	}
+	delete(w.trailing, mac)
+	w.notify(w.suppressed[mac])
+	delete(w.suppressed, mac)
+}
+
+// notify delivers e in the background, starting a new debounce period for its
+// tag. w.mu must be held.
+func (w *movementWebhook) notify(e movementEvent) {
+	w.notified[e.MAC] = time.Now()
+	body, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Encoding movement event", "err", err)
+		return
+	}
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		w.deliver(e.MAC, body)
+	}()
+}
+
+// deliver posts body to the webhook.
+func (w *movementWebhook) deliver(mac string, body []byte) {
+	if err := postWebhook(w.client, w.url, body); err != nil {
+		slog.Warn("Posting movement event", "mac", mac, "attempts", webhookAttempts, "err", err)
+		return
+	}
+	slog.Info("Notified movement", "mac", mac)
+}
+
+// postWebhook posts the JSON body to url, retrying with an increasing delay on failure.
+func postWebhook(client *http.Client, url string, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = post(client, url, body); err == nil {
+			return nil
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// close notifies the movements pending the end of their debounce period right
+// away and waits for the deliveries in progress.
+func (w *movementWebhook) close() {
+	w.mu.Lock()
+	for mac, t := range w.trailing {
+		if t.Stop() {
+			w.pending.Done()
+		}
+		delete(w.trailing, mac)
+		w.notify(w.suppressed[mac])
+		delete(w.suppressed, mac)
+	}
+	w.mu.Unlock()
+	w.pending.Wait()
+}